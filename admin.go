@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var adminAddr = flag.String("admin-addr", "unix:/run/knl-nft/admin.sock",
+	"listen address of the admin API, unix:<path> for a socket only accessible by the daemon's user (empty to disable)")
+
+func startAdminAPI() {
+	if *adminAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mappings", handleMappings)
+	mux.HandleFunc("/mappings/", handleMapping)
+	mux.HandleFunc("/overrides", handleOverrides)
+	mux.HandleFunc("/mirrors", handleMirrors)
+	mux.HandleFunc("/mirrors/", handleMirror)
+	mux.HandleFunc("/misses", handleMisses)
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	listener, err := adminListen(*adminAddr)
+	if err != nil {
+		log.Fatal().Err(err).Str("admin-addr", *adminAddr).Msg("admin API failed")
+	}
+
+	go func() {
+		err := http.Serve(listener, mux)
+		log.Fatal().Err(err).Str("admin-addr", *adminAddr).Msg("admin API failed")
+	}()
+}
+
+// adminListen listens on a TCP address, or on a unix socket (unix:<path>) only the daemon's user can connect to.
+// The admin API can remove mappings and mirror traffic, and has no authentication.
+func adminListen(addr string) (listener net.Listener, err error) {
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if !isUnix {
+		return net.Listen("tcp", addr)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return
+	}
+
+	// the socket of a previous run
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	// created without permissions for the group and others, so there's no window where they can connect
+	umask := syscall.Umask(0o177)
+	listener, err = net.Listen("unix", path)
+	syscall.Umask(umask)
+	return
+}
+
+func handleMappings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, getState().Mappings)
+}
+
+// handleMapping serves /mappings/{proto}/{port}
+func handleMapping(w http.ResponseWriter, r *http.Request) {
+	key, ok := portKeyFromPath(w, r, "/mappings/")
+	if !ok {
+		return
+	}
+	protocol, port := key.Protocol, key.HostPort
+
+	var mapping *Mapping
+	for _, m := range getState().Mappings {
+		if m.Key() == key {
+			mapping = &m
+			break
+		}
+	}
+
+	if mapping == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, mapping)
+
+	case http.MethodDelete:
+		// a concurrent run would publish the mapping again if it rendered the rules before the override
+		rulesMutex.Lock()
+		addOverride(key)
+
+		// remove it now instead of waiting for the next run
+		objects, err := nftListTable()
+		if err == nil {
+			err = prune(key, objects, false)
+		}
+		rulesMutex.Unlock()
+
+		if err != nil {
+			log.Error().Err(err).Str("protocol", protocol).Int("host-port", port).Msg("failed to remove mapping")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Info().Str("protocol", protocol).Int("host-port", port).Str("remote-addr", r.RemoteAddr).Msg("mapping removed through the admin API")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleOverrides(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, listOverrides())
+}
+
+func handleMirrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, listMirrors())
+}
+
+// handleMirror serves /mirrors/{proto}/{port}
+func handleMirror(w http.ResponseWriter, r *http.Request) {
+	key, ok := portKeyFromPath(w, r, "/mirrors/")
+	if !ok {
+		return
+	}
+
+	log := log.With().Str("protocol", key.Protocol).Int("host-port", key.HostPort).Str("remote-addr", r.RemoteAddr).Logger()
+
+	switch r.Method {
+	case http.MethodPost:
+		duration := 5 * time.Minute
+		if s := r.URL.Query().Get("duration"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			duration = d
+		}
+
+		if duration > *mirrorMaxDuration {
+			http.Error(w, "duration is over "+mirrorMaxDuration.String(), http.StatusBadRequest)
+			return
+		}
+
+		mirror := Mirror{
+			PortKey: key,
+			To:      r.URL.Query().Get("to"),
+			Device:  r.URL.Query().Get("device"),
+			Until:   time.Now().Add(duration).Truncate(time.Second),
+		}
+
+		if err := mirror.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !mirrorAllowed(mirror.To) {
+			log.Warn().Str("to", mirror.To).Msg("mirror to a destination not allowed by -mirror-destinations refused")
+			http.Error(w, "destination not allowed", http.StatusForbidden)
+			return
+		}
+
+		setMirror(mirror)
+
+		log.Info().Str("to", mirror.To).Time("until", mirror.Until).Msg("mirror set through the admin API")
+		writeJSON(w, mirror)
+
+	case http.MethodDelete:
+		if !removeMirror(key) {
+			http.NotFound(w, r)
+			return
+		}
+
+		log.Info().Msg("mirror removed through the admin API")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleMisses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	counts, err := listMissCounts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, counts)
+}
+
+// portKeyFromPath parses a {prefix}{proto}/{port} path, writing the error response if it's invalid.
+func portKeyFromPath(w http.ResponseWriter, r *http.Request, prefix string) (key PortKey, ok bool) {
+	protocol, portStr, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	port, err := strconv.Atoi(portStr)
+	if !ok || err != nil || !validPort(port) {
+		http.NotFound(w, r)
+		return key, false
+	}
+
+	protocol, err = validProtocol(protocol)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return key, false
+	}
+
+	return PortKey{protocol, port}, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("failed to write admin API response")
+	}
+}
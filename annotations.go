@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Pod annotations setting policies of the pod's host ports. Their value is a list of "[protocol/]port=value"
+// separated by commas, the port being the host port requested by the container.
+const (
+	bandwidthAnnotation = "knl-nft/bandwidth"
+	synproxyAnnotation  = "knl-nft/synproxy"
+	// connection rate limits are given in the "20/minute per /24" format
+	connRateLimitAnnotation = "knl-nft/conn-rate-limit"
+)
+
+var (
+	// invalidAnnotationsLogged avoids logging the same invalid annotation on each run
+	invalidAnnotationsLogged = map[string]bool{}
+	newInvalidAnnotations    = map[string]bool{}
+)
+
+// annotationSettings returns the policy settings given to the mapping by its pod annotations.
+func annotationSettings(m Mapping) (settings PolicySettings) {
+	if value, ok := podPortAnnotation(m, bandwidthAnnotation); ok {
+		bandwidth, err := parseBandwidth(value)
+		if err != nil {
+			logInvalidAnnotation(m, bandwidthAnnotation, err)
+		} else {
+			settings.Bandwidth = bandwidth
+		}
+	}
+
+	if value, ok := podPortAnnotation(m, synproxyAnnotation); ok {
+		synproxy, err := strconv.ParseBool(value)
+		if err != nil {
+			logInvalidAnnotation(m, synproxyAnnotation, err)
+		} else {
+			settings.Synproxy = &synproxy
+		}
+	}
+
+	if value, ok := podPortAnnotation(m, connRateLimitAnnotation); ok {
+		limit, err := parseConnRateLimit(value)
+		if err != nil {
+			logInvalidAnnotation(m, connRateLimitAnnotation, err)
+		} else {
+			settings.ConnRateLimit = limit
+		}
+	}
+
+	return
+}
+
+// podPortAnnotation returns the value of the annotation for the mapping's port.
+func podPortAnnotation(m Mapping, annotation string) (value string, found bool) {
+	list := m.podAnnotations[annotation]
+	if list == "" {
+		return
+	}
+
+	port := m.HostPort
+	if m.RequestedHostPort != 0 {
+		port = m.RequestedHostPort
+	}
+
+	for _, item := range strings.Split(list, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			logInvalidAnnotation(m, annotation, fmt.Errorf("invalid item: %q", item))
+			continue
+		}
+
+		protocol, portStr, hasProtocol := strings.Cut(key, "/")
+		if !hasProtocol {
+			portStr = protocol
+		} else if !strings.EqualFold(protocol, m.Protocol) {
+			continue
+		}
+
+		if portStr != strconv.Itoa(port) {
+			continue
+		}
+
+		return strings.TrimSpace(value), true
+	}
+
+	return
+}
+
+func logInvalidAnnotation(m Mapping, annotation string, err error) {
+	key := m.PodUID + "/" + annotation + "/" + err.Error()
+
+	newInvalidAnnotations[key] = true
+	if invalidAnnotationsLogged[key] {
+		return
+	}
+
+	log.Warn().Err(err).Str("pod-ns", m.PodNamespace).Str("pod-name", m.PodName).Str("annotation", annotation).
+		Msg("invalid annotation ignored")
+}
+
+// resetInvalidAnnotations must be called after each run so only current invalid annotations are remembered.
+func resetInvalidAnnotations() {
+	invalidAnnotationsLogged, newInvalidAnnotations = newInvalidAnnotations, map[string]bool{}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	blocklistSource  = flag.String("blocklist", "", "file or http(s) URL of CIDRs to drop before host ports DNAT (one per line)")
+	blocklistRefresh = flag.Duration("blocklist-refresh", time.Hour, "blocklist refresh interval")
+)
+
+var (
+	blocklistMutex sync.Mutex
+	blocklist      []string
+)
+
+func getBlocklist() []string {
+	blocklistMutex.Lock()
+	defer blocklistMutex.Unlock()
+	return blocklist
+}
+
+// startBlocklistRefresh loads the blocklist now and then on each refresh interval. The previous list is kept on errors.
+func startBlocklistRefresh() {
+	if *blocklistSource == "" {
+		return
+	}
+
+	refresh := func() {
+		list, err := loadBlocklist(*blocklistSource)
+		if err != nil {
+			log.Error().Err(err).Str("blocklist", *blocklistSource).Msg("failed to load the blocklist")
+			return
+		}
+
+		blocklistMutex.Lock()
+		blocklist = list
+		blocklistMutex.Unlock()
+
+		log.Info().Int("prefixes", len(list)).Msg("blocklist loaded")
+	}
+
+	refresh()
+
+	go func() {
+		for range time.Tick(*blocklistRefresh) {
+			refresh()
+		}
+	}()
+}
+
+func loadBlocklist(source string) (list []string, err error) {
+	var in io.ReadCloser
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		ctx, cancel := context.WithTimeout(appCtx, 30*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", source, resp.Status)
+		}
+
+		in = resp.Body
+	} else {
+		in, err = os.Open(source)
+		if err != nil {
+			return
+		}
+	}
+
+	defer in.Close()
+
+	return parseBlocklist(io.LimitReader(in, 64<<20))
+}
+
+// parseBlocklist reads a CIDR per line, ignoring comments ("#" or ";") and what follows the CIDR on the line.
+// Non-IPv4 entries are ignored.
+func parseBlocklist(in io.Reader) (list []string, err error) {
+	prefixes := make([]netip.Prefix, 0)
+	invalid := 0
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line, _, _ = strings.Cut(line, ";")
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		prefix, err := parsePrefix(fields[0])
+		if err != nil {
+			invalid++
+			continue
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	if invalid != 0 {
+		log.Warn().Int("count", invalid).Msg("invalid or non-IPv4 blocklist entries ignored")
+	}
+
+	return canonicalPrefixes(prefixes), nil
+}
+
+// canonicalPrefixes sorts the prefixes and removes the ones included in another.
+func canonicalPrefixes(prefixes []netip.Prefix) (list []string) {
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return a.Bits() - b.Bits()
+	})
+
+	list = make([]string, 0, len(prefixes))
+
+	var prev netip.Prefix
+	for _, prefix := range prefixes {
+		if prev.IsValid() && prev.Overlaps(prefix) {
+			// sorted, so prefix is included in prev
+			continue
+		}
+		list = append(list, prefix.String())
+		prev = prefix
+	}
+
+	return
+}
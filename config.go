@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var configDir = flag.String("config-dir", "/etc/knl-nft/conf.d", "directory of YAML configuration fragments, merged and reloaded on change")
+
+// Config is the merge of all the configuration fragments.
+type Config struct {
+	// StaticMappings are published in addition to the containers' mappings, and have precedence over them.
+	StaticMappings []StaticMapping `yaml:"staticMappings"`
+	// Exclusions prevent matching container mappings from being published.
+	Exclusions []Match `yaml:"exclusions"`
+	// Policies apply to the published mappings they match.
+	Policies []Policy `yaml:"policies"`
+}
+
+type StaticMapping struct {
+	Protocol string `yaml:"protocol"`
+	HostPort int    `yaml:"hostPort"`
+	IP       string `yaml:"ip"`
+	Port     int    `yaml:"port"`
+}
+
+// Match selects mappings. Empty fields match everything.
+type Match struct {
+	Protocol  string `yaml:"protocol"`
+	HostPorts string `yaml:"hostPorts"`
+	Namespace string `yaml:"namespace"`
+	// Pod is a pattern as defined by path.Match
+	Pod string `yaml:"pod"`
+
+	hostPorts *PortRange
+}
+
+// Policy settings are merged from all matching policies, the first one defining a setting wins.
+type Policy struct {
+	Match          `yaml:",inline"`
+	PolicySettings `yaml:",inline"`
+}
+
+// PolicySettings are the settings applied to a published mapping.
+type PolicySettings struct {
+	// Sources are the only prefixes allowed to reach the host port.
+	Sources []string `yaml:"sources" json:"sources,omitempty"`
+	// Bandwidth limits the traffic of the host port (ie: "10 mbytes/second").
+	Bandwidth string `yaml:"bandwidth" json:"bandwidth,omitempty"`
+	// Synproxy absorbs SYN floods against the (TCP) host port in the kernel.
+	Synproxy *bool `yaml:"synproxy" json:"synproxy,omitempty"`
+	// ConnRateLimit limits the new connections per source (ie: "20/minute", "100/hour per /24").
+	ConnRateLimit string `yaml:"connRateLimit" json:"connRateLimit,omitempty"`
+}
+
+func (c *Config) validate() (err error) {
+	for i := range c.StaticMappings {
+		s := &c.StaticMappings[i]
+		if s.Protocol == "" {
+			s.Protocol = "TCP"
+		}
+		if s.Protocol, err = validProtocol(s.Protocol); err != nil {
+			return
+		}
+		if !validPort(s.HostPort) || !validPort(s.Port) {
+			return fmt.Errorf("static mapping %d: invalid port", i)
+		}
+		ip, err := netip.ParseAddr(s.IP)
+		if err != nil || !ip.Is4() {
+			return fmt.Errorf("static mapping %d: invalid IPv4 address: %q", i, s.IP)
+		}
+		s.IP = ip.String()
+	}
+
+	for i := range c.Exclusions {
+		if err = c.Exclusions[i].validate(); err != nil {
+			return fmt.Errorf("exclusion %d: %w", i, err)
+		}
+	}
+
+	for i := range c.Policies {
+		p := &c.Policies[i]
+		if err = p.Match.validate(); err != nil {
+			return fmt.Errorf("policy %d: %w", i, err)
+		}
+
+		if err = p.PolicySettings.validate(); err != nil {
+			return fmt.Errorf("policy %d: %w", i, err)
+		}
+	}
+
+	return
+}
+
+func (m *Match) validate() (err error) {
+	if m.Protocol != "" {
+		if m.Protocol, err = validProtocol(m.Protocol); err != nil {
+			return
+		}
+	}
+
+	if m.HostPorts != "" {
+		r, err := parsePortRange(m.HostPorts)
+		if err != nil {
+			return err
+		}
+		m.hostPorts = &r
+	}
+
+	if _, err = path.Match(m.Pod, ""); err != nil {
+		return fmt.Errorf("invalid pod pattern: %w", err)
+	}
+
+	return
+}
+
+func (m Match) matches(mapping Mapping) bool {
+	if m.Protocol != "" && m.Protocol != mapping.Protocol {
+		return false
+	}
+	if m.hostPorts != nil && !m.hostPorts.Contains(mapping.HostPort) {
+		return false
+	}
+	if m.Namespace != "" && m.Namespace != mapping.PodNamespace {
+		return false
+	}
+	if m.Pod != "" {
+		if ok, _ := path.Match(m.Pod, mapping.PodName); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Config) excluded(mapping Mapping) bool {
+	for _, m := range c.Exclusions {
+		if m.matches(mapping) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *PolicySettings) validate() (err error) {
+	for j, source := range s.Sources {
+		prefix, err := parsePrefix(source)
+		if err != nil {
+			return fmt.Errorf("source %d: %w", j, err)
+		}
+		s.Sources[j] = prefix.String()
+	}
+
+	// canonical order for rendering
+	sort.Strings(s.Sources)
+	s.Sources = slices.Compact(s.Sources)
+
+	if s.Bandwidth != "" {
+		if s.Bandwidth, err = parseBandwidth(s.Bandwidth); err != nil {
+			return
+		}
+	}
+
+	if s.ConnRateLimit != "" {
+		if s.ConnRateLimit, err = parseConnRateLimit(s.ConnRateLimit); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// merge sets the settings not yet defined from other.
+func (s *PolicySettings) merge(other PolicySettings) {
+	if s.Sources == nil {
+		s.Sources = other.Sources
+	}
+	if s.Bandwidth == "" {
+		s.Bandwidth = other.Bandwidth
+	}
+	if s.Synproxy == nil {
+		s.Synproxy = other.Synproxy
+	}
+	if s.ConnRateLimit == "" {
+		s.ConnRateLimit = other.ConnRateLimit
+	}
+}
+
+var bandwidthRegexp = regexp.MustCompile(`^([0-9]+) *(bytes|kbytes|mbytes)/(second|minute|hour|day)$`)
+
+// parseBandwidth validates and normalizes an nft byte rate (ie: "10 mbytes/second").
+func parseBandwidth(s string) (rate string, err error) {
+	match := bandwidthRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if match == nil {
+		return "", fmt.Errorf("invalid bandwidth: %q", s)
+	}
+
+	return match[1] + " " + match[2] + "/" + match[3], nil
+}
+
+var connRateLimitRegexp = regexp.MustCompile(`^([0-9]+)/(second|minute|hour|day)(?: +per +/([0-9]+))?$`)
+
+// parseConnRateLimit validates and normalizes a per-source connection rate (ie: "20/minute per /32").
+func parseConnRateLimit(s string) (limit string, err error) {
+	match := connRateLimitRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if match == nil {
+		return "", fmt.Errorf("invalid connection rate limit: %q", s)
+	}
+
+	prefix := 32
+	if match[3] != "" {
+		prefix, _ = strconv.Atoi(match[3])
+		if prefix < 1 || prefix > 32 {
+			return "", fmt.Errorf("invalid connection rate limit prefix: %q", s)
+		}
+	}
+
+	return match[1] + "/" + match[2] + " per /" + strconv.Itoa(prefix), nil
+}
+
+// policy returns the merged settings of the policies matching the mapping.
+func (c *Config) policy(mapping Mapping) (settings PolicySettings) {
+	for _, p := range c.Policies {
+		if p.matches(mapping) {
+			settings.merge(p.PolicySettings)
+		}
+	}
+	return
+}
+
+func (c *Config) staticMappings() (mappings []Mapping) {
+	mappings = make([]Mapping, 0, len(c.StaticMappings))
+	for _, s := range c.StaticMappings {
+		mappings = append(mappings, Mapping{
+			Protocol:      s.Protocol,
+			HostPort:      s.HostPort,
+			IP:            s.IP,
+			ContainerPort: s.Port,
+		})
+	}
+	return
+}
+
+func validProtocol(protocol string) (string, error) {
+	switch p := strings.ToUpper(protocol); p {
+	case "TCP", "UDP":
+		return p, nil
+	default:
+		return "", fmt.Errorf("unsupported protocol: %q", protocol)
+	}
+}
+
+func validPort(port int) bool {
+	return port >= 1 && port <= 65535
+}
+
+// parsePrefix parses an IPv4 prefix, a single address being a /32.
+func parsePrefix(s string) (prefix netip.Prefix, err error) {
+	if strings.Contains(s, "/") {
+		prefix, err = netip.ParsePrefix(s)
+	} else {
+		var ip netip.Addr
+		ip, err = netip.ParseAddr(s)
+		prefix = netip.PrefixFrom(ip, ip.BitLen())
+	}
+
+	if err != nil {
+		return
+	}
+	if !prefix.Addr().Is4() {
+		err = fmt.Errorf("not an IPv4 prefix: %q", s)
+		return
+	}
+
+	return prefix.Masked(), nil
+}
+
+var (
+	currentConfig   = &Config{}
+	configSignature []byte
+)
+
+// loadConfig returns the current configuration, reloading the fragments if they changed.
+// On error, the previous configuration is kept.
+func loadConfig() *Config {
+	files, signature, err := listConfigFiles()
+	if err != nil {
+		log.Error().Err(err).Str("config-dir", *configDir).Msg("failed to read the configuration directory")
+		return currentConfig
+	}
+
+	if bytes.Equal(signature, configSignature) {
+		return currentConfig
+	}
+
+	configSignature = signature
+
+	cfg := &Config{}
+	for _, file := range files {
+		fragment := Config{}
+
+		if err := readConfigFile(file, &fragment); err != nil {
+			log.Error().Err(err).Str("file", file).Msg("invalid configuration fragment, keeping the previous configuration")
+			return currentConfig
+		}
+
+		cfg.StaticMappings = append(cfg.StaticMappings, fragment.StaticMappings...)
+		cfg.Exclusions = append(cfg.Exclusions, fragment.Exclusions...)
+		cfg.Policies = append(cfg.Policies, fragment.Policies...)
+	}
+
+	log.Info().Int("files", len(files)).Msg("configuration loaded")
+
+	currentConfig = cfg
+	return cfg
+}
+
+// listConfigFiles returns the configuration fragments in lexical order, and a signature changing with their content.
+func listConfigFiles() (files []string, signature []byte, err error) {
+	entries, err := os.ReadDir(*configDir)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return
+	}
+
+	sig := new(bytes.Buffer)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if ext := filepath.Ext(name); ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+
+		file := filepath.Join(*configDir, name)
+
+		// follow symlinks (ie: ConfigMap mounts)
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		files = append(files, file)
+		fmt.Fprintln(sig, name, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return files, sig.Bytes(), nil
+}
+
+func readConfigFile(file string, cfg *Config) (err error) {
+	ba, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(ba))
+	dec.KnownFields(true)
+
+	if err = dec.Decode(cfg); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil // empty file
+		}
+		return
+	}
+
+	return cfg.validate()
+}
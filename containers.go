@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+	cri "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// Container is a running container requesting host ports.
+type Container struct {
+	ID        string        `yaml:"id"`
+	Name      string        `yaml:"name"`
+	CreatedAt int64         `yaml:"createdAt"`
+	Ports     []PortMapping `yaml:"ports"`
+	Pod       Pod           `yaml:"pod"`
+}
+
+type Pod struct {
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+	UID       string `yaml:"uid"`
+	IP        string `yaml:"ip"`
+
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+type PortMapping struct {
+	HostPort      int    `yaml:"hostPort"`
+	ContainerPort int    `yaml:"containerPort"`
+	Protocol      string `yaml:"protocol"`
+}
+
+// listContainers returns the running containers requesting host ports, oldest first.
+func listContainers(ctx context.Context, runtimeService cri.RuntimeServiceClient) (containers []Container, ok bool) {
+	containersResp, err := runtimeService.ListContainers(ctx, &cri.ListContainersRequest{})
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list containers")
+		return
+	}
+
+	criContainers := containersResp.Containers
+	sort.Slice(criContainers, func(i, j int) bool {
+		ci, cj := criContainers[i], criContainers[j]
+		if ci.CreatedAt != cj.CreatedAt {
+			return ci.CreatedAt < cj.CreatedAt
+		}
+		return ci.Id < cj.Id
+	})
+
+	containers = make([]Container, 0)
+
+	for _, ctr := range criContainers {
+		if ctr.State != cri.ContainerState_CONTAINER_RUNNING {
+			continue
+		}
+
+		portsStr := ctr.Annotations["io.kubernetes.container.ports"]
+		if portsStr == "" {
+			continue
+		}
+
+		log := log.With().Str("container-id", ctr.Id).Str("container-name", ctr.Metadata.Name).Logger()
+
+		ports := make([]PortMapping, 0)
+		if err := json.Unmarshal([]byte(portsStr), &ports); err != nil {
+			log.Error().Err(err).Msg("invalid container ports")
+			return
+		}
+
+		if len(ports) == 0 {
+			continue
+		}
+
+		pod, err := runtimeService.PodSandboxStatus(ctx, &cri.PodSandboxStatusRequest{PodSandboxId: ctr.PodSandboxId})
+		if err != nil {
+			log.Error().Err(err).Str("pod-id", ctr.PodSandboxId).Msg("failed to get pod status")
+			return
+		}
+
+		ip := pod.Status.Network.Ip
+		if ip == "" {
+			continue
+		}
+
+		containers = append(containers, Container{
+			ID:        ctr.Id,
+			Name:      ctr.Metadata.Name,
+			CreatedAt: ctr.CreatedAt,
+			Ports:     ports,
+			Pod: Pod{
+				Namespace: pod.Status.Metadata.Namespace,
+				Name:      pod.Status.Metadata.Name,
+				UID:       pod.Status.Metadata.Uid,
+				IP:        ip,
+
+				Annotations: pod.Status.Annotations,
+			},
+		})
+	}
+
+	return containers, true
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	daemonize   = flag.Bool("daemon", false, "detach from the terminal and run in the background")
+	pidFile     = flag.String("pidfile", "", "file where the process id is written")
+	logFile     = flag.String("log-file", "", "file to log to instead of stderr")
+	logMaxSize  = flag.Int64("log-max-size", 10, "size in MiB at which the log file is rotated (0 to disable rotation)")
+	logMaxFiles = flag.Int("log-max-files", 5, "number of rotated log files to keep")
+)
+
+const daemonizedEnv = "KNL_NFT_DAEMONIZED"
+
+// setupProcess handles daemonization, file logging and the pidfile.
+func setupProcess() {
+	if *daemonize && os.Getenv(daemonizedEnv) == "" {
+		if *logFile == "" {
+			log.Warn().Msg("running as a daemon without -log-file, logs will be lost")
+		}
+
+		cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+		cmd.Env = append(os.Environ(), daemonizedEnv+"=1")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		// stdin, stdout and stderr are left nil so they're connected to /dev/null
+
+		if err := cmd.Start(); err != nil {
+			log.Fatal().Err(err).Msg("failed to start daemon")
+		}
+
+		// written before returning, so it's there as soon as the init script reads it
+		if *pidFile != "" {
+			if err := writePidFile(cmd.Process.Pid); err != nil {
+				cmd.Process.Kill()
+				log.Fatal().Err(err).Str("pidfile", *pidFile).Msg("failed to write pidfile")
+			}
+		}
+
+		os.Exit(0)
+	}
+
+	if *logFile != "" {
+		out, err := openRotatingFile(*logFile, *logMaxSize<<20, *logMaxFiles)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to open log file")
+		}
+
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: out, NoColor: true})
+	}
+
+	if *pidFile != "" {
+		// the daemonizing parent already wrote it
+		if os.Getenv(daemonizedEnv) == "" {
+			if err := writePidFile(os.Getpid()); err != nil {
+				log.Fatal().Err(err).Str("pidfile", *pidFile).Msg("failed to write pidfile")
+			}
+		}
+
+		log.Logger = log.Logger.Hook(pidFileHook{})
+	}
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+
+		sig := <-c
+		log.Info().Str("signal", sig.String()).Msg("exiting")
+
+		appCancel()
+
+		// wait for a run in progress, so it doesn't apply rules or write the state file while exiting
+		rulesMutex.Lock()
+
+		// the table and its SYN proxy rules stay in place, so the sysctls they need are kept too; the next run restores
+		// them (from the state file) when no host port uses the SYN proxy anymore
+		if *pidFile != "" {
+			os.Remove(*pidFile)
+		}
+
+		os.Exit(0)
+	}()
+}
+
+func writePidFile(pid int) error {
+	return os.WriteFile(*pidFile, []byte(strconv.Itoa(pid)+"\n"), 0o644)
+}
+
+// pidFileHook removes the pidfile when exiting on a fatal error.
+type pidFileHook struct{}
+
+func (pidFileHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	if level == zerolog.FatalLevel {
+		os.Remove(*pidFile)
+	}
+}
+
+// rotatingFile is a log file rotated when it reaches a given size.
+// Rotated files are named with a numeric suffix, ".1" being the most recent.
+type rotatingFile struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (f *rotatingFile, err error) {
+	f = &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	err = f.open()
+	return
+}
+
+func (f *rotatingFile) open() (err error) {
+	f.file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return
+	}
+
+	stat, err := f.file.Stat()
+	if err != nil {
+		return
+	}
+
+	f.size = stat.Size()
+	return
+}
+
+func (f *rotatingFile) Write(p []byte) (n int, err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.file == nil {
+		// previous rotation failed to reopen the file
+		if err = f.open(); err != nil {
+			return
+		}
+	}
+
+	if f.maxSize > 0 && f.size != 0 && f.size+int64(len(p)) > f.maxSize {
+		if err = f.rotate(); err != nil {
+			return
+		}
+	}
+
+	n, err = f.file.Write(p)
+	f.size += int64(n)
+	return
+}
+
+func (f *rotatingFile) rotate() (err error) {
+	err = f.file.Close()
+	f.file = nil
+	if err != nil {
+		return
+	}
+
+	if f.maxFiles <= 0 {
+		os.Remove(f.path)
+	} else {
+		os.Remove(f.rotatedPath(f.maxFiles))
+		for i := f.maxFiles - 1; i > 0; i-- {
+			os.Rename(f.rotatedPath(i), f.rotatedPath(i+1))
+		}
+
+		if err = os.Rename(f.path, f.rotatedPath(1)); err != nil {
+			return
+		}
+	}
+
+	return f.open()
+}
+
+func (f *rotatingFile) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", f.path, n)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "knl-nft.log")
+
+	// a previous run's log, counted in the size
+	if err := os.WriteFile(path, []byte("0000000\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openRotatingFile(path, 16, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"1111111\n", "2222222\n", "3333333\n", "4444444\n", "5555555\n", "6666666\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// larger than the max size, written anyway in a new file
+	if _, err := f.Write([]byte(strings.Repeat("7", 19) + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		path:        strings.Repeat("7", 19) + "\n",
+		path + ".1": "6666666\n",
+		path + ".2": "4444444\n5555555\n",
+		path + ".3": "",
+	}
+	for file, content := range expected {
+		ba, err := os.ReadFile(file)
+		if content == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s: should have been removed", file)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ba) != content {
+			t.Errorf("%s = %q, want %q", file, ba, content)
+		}
+	}
+}
+
+func TestRotatingFileWithoutRotatedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "knl-nft.log")
+
+	f, err := openRotatingFile(path, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"1111111\n", "2222222\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ba, err := os.ReadFile(path); err != nil || string(ba) != "2222222\n" {
+		t.Errorf("%s = %q (%v), want the last line only", path, ba, err)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("%s.1: should not exist", path)
+	}
+}
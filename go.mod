@@ -6,6 +6,7 @@ require (
 	github.com/cespare/xxhash v1.1.0
 	github.com/rs/zerolog v1.31.0
 	google.golang.org/grpc v1.58.3
+	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/cri-api v0.29.1
 )
 
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	nodeName = envFlag("node-name", "name of this node", "NODE_NAME", "")
+
+	// kube is the Kubernetes API client, nil when not running in a cluster.
+	kube *kubeClient
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal Kubernetes API client using the pod's service account.
+type kubeClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+func newKubeClient() *kubeClient {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		log.Info().Msg("not running in a Kubernetes cluster, API features disabled")
+		return nil
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read the service account CA, API features disabled")
+		return nil
+	}
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(ca)
+
+	return &kubeClient{
+		baseURL: "https://" + net.JoinHostPort(host, port),
+		http: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: rootCAs}},
+		},
+	}
+}
+
+func (k *kubeClient) do(ctx context.Context, method, path string, in, out any) (err error) {
+	var body io.Reader
+	if in != nil {
+		ba, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(ba)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.baseURL+path, body)
+	if err != nil {
+		return
+	}
+
+	// the token is rotated, so read it on each request
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	if out == nil {
+		return
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// postPodEvent records an Event on the pod of the mapping. It does not block and is a no-op outside a cluster.
+func (k *kubeClient) postPodEvent(m Mapping, eventType, reason, message string) {
+	if k == nil || m.PodNamespace == "" {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	event := map[string]any{
+		"metadata": map[string]any{
+			"generateName": m.PodName + ".",
+			"namespace":    m.PodNamespace,
+		},
+		"involvedObject": map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"namespace":  m.PodNamespace,
+			"name":       m.PodName,
+			"uid":        m.PodUID,
+		},
+		"type":           eventType,
+		"reason":         reason,
+		"message":        message,
+		"source":         map[string]any{"component": "knl-nft", "host": *nodeName},
+		"firstTimestamp": now,
+		"lastTimestamp":  now,
+		"count":          1,
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(appCtx, 10*time.Second)
+		defer cancel()
+
+		err := k.do(ctx, http.MethodPost, "/api/v1/namespaces/"+m.PodNamespace+"/events", event, nil)
+		if err != nil {
+			log.Error().Err(err).Str("pod-ns", m.PodNamespace).Str("pod-name", m.PodName).Str("reason", reason).Msg("failed to post pod event")
+		}
+	}()
+}
@@ -1,18 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
-	"sort"
-	"strconv"
+	"slices"
+	"sync"
 	"time"
 
-	"github.com/cespare/xxhash"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
@@ -42,6 +39,67 @@ func main() {
 	log.Logger = log.Output(zerolog.NewConsoleWriter())
 	flag.Parse()
 
+	switch command := flag.Arg(0); command {
+	case "":
+	case "render":
+		renderCommand(flag.Args()[1:])
+		return
+	case "prune":
+		pruneCommand(flag.Args()[1:])
+		return
+	case "migrate":
+		migrateCommand(flag.Args()[1:])
+		return
+	default:
+		log.Fatal().Str("command", command).Msg("unknown command")
+	}
+
+	setupProcess()
+
+	if *reassignPortRangeFlag != "" {
+		r, err := parsePortRange(*reassignPortRangeFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid reassign-port-range")
+		}
+		reassignPortRange = &r
+	}
+
+	if err := Mark(*hostPortCtMark).validate(); err != nil {
+		log.Fatal().Err(err).Msg("invalid host-port-ct-mark")
+	}
+
+	if *connRateSize <= 0 {
+		log.Fatal().Int("conn-rate-size", *connRateSize).Msg("invalid conn-rate-size")
+	}
+
+	if *missPortsFlag != "" {
+		list, err := parseMissPorts(*missPortsFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid miss-ports")
+		}
+		missPortRanges = list
+	}
+
+	if *mirrorDestinationsFlag != "" {
+		list, err := parseMirrorDestinations(*mirrorDestinationsFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid mirror-destinations")
+		}
+		mirrorDestinations = list
+	}
+
+	kube = newKubeClient()
+
+	resolveNodeSettings()
+
+	restoreState()
+
+	startAdminAPI()
+
+	startMetricsServer()
+
+	startBlocklistRefresh()
+
 	conn, err := dial()
 	if err != nil {
 		log.Fatal().Err(err).Str("runtime-endpoint", *containerRuntimeEndpoint).Msg("failed to connect to CRI container runtime service")
@@ -71,121 +129,50 @@ func dial() (conn *grpc.ClientConn, err error) {
 		grpc.WithTransportCredentials(insecure.NewCredentials()))
 }
 
-var prevRulesHash uint64
+var (
+	prevRulesHash uint64
+
+	// rulesMutex serializes the changes of the applied rules (by runs and by the admin API)
+	rulesMutex sync.Mutex
+)
 
 func run(runtimeService cri.RuntimeServiceClient) (ok bool) {
 	ctx, cancel := context.WithTimeout(appCtx, 5*time.Second)
 	defer cancel()
 
-	portMapTCP := new(bytes.Buffer)
-	portMapUDP := new(bytes.Buffer)
+	cfg := loadConfig()
 
-	containersResp, err := runtimeService.ListContainers(ctx, &cri.ListContainersRequest{})
-	if err != nil {
-		log.Error().Err(err).Msg("failed to list containers")
+	containers, ok := listContainers(ctx, runtimeService)
+	if !ok {
 		return
 	}
 
-	containers := containersResp.Containers
-	sort.Slice(containers, func(i, j int) bool {
-		ci, cj := containers[i], containers[j]
-		if ci.CreatedAt != cj.CreatedAt {
-			return ci.CreatedAt < cj.CreatedAt
-		}
-		return ci.Id < cj.Id
-	})
-
-	seenHostPorts := map[int]bool{}
-
-	for _, ctr := range containers {
-		if ctr.State != cri.ContainerState_CONTAINER_RUNNING {
-			continue
-		}
-
-		portsStr := ctr.Annotations["io.kubernetes.container.ports"]
-		if portsStr == "" {
-			continue
-		}
-
-		log := log.With().Str("container-id", ctr.Id).Str("container-name", ctr.Metadata.Name).Logger()
-
-		ports := make([]PortMapping, 0)
-		if err := json.Unmarshal([]byte(portsStr), &ports); err != nil {
-			log.Error().Err(err).Msg("invalid container ports")
-			return
-		}
-
-		if len(ports) == 0 {
-			continue
-		}
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
 
-		pod, err := runtimeService.PodSandboxStatus(ctx, &cri.PodSandboxStatusRequest{PodSandboxId: ctr.PodSandboxId})
-		if err != nil {
-			log.Error().Err(err).Str("pod-id", ctr.PodSandboxId).Msg("failed to get pod status")
-			return
-		}
+	mappings := buildMappings(containers, cfg)
+	mappings = applyOverrides(containers, mappings)
+	mappings = applyMirrors(mappings, time.Now())
 
-		ip := pod.Status.Network.Ip
-		if ip == "" {
-			continue
-		}
+	buf, hash, err := renderRules(RenderInput{
+		Mappings:  mappings,
+		Blocklist: getBlocklist(),
+		Misses:    missPorts(mappings, time.Now()),
 
-		log = log.With().Str("pod-ns", pod.Status.Metadata.Namespace).Str("pod-name", pod.Status.Metadata.Name).Logger()
-
-		for _, port := range ports {
-			hostPort := port.HostPort
-			if hostPort == 0 {
-				continue
-			}
-
-			if seenHostPorts[hostPort] {
-				log.Warn().Int("host-port", hostPort).Msg("duplicate host port ignored")
-				continue
-			}
-
-			seenHostPorts[hostPort] = true
-
-			mapping := "      " + strconv.Itoa(hostPort) + " : " + ip + " . " + strconv.Itoa(port.ContainerPort) + ",\n"
-			switch port.Protocol {
-			case "TCP":
-				portMapTCP.WriteString(mapping)
-			case "UDP":
-				portMapUDP.WriteString(mapping)
-			}
-		}
-	}
-
-	buf := new(bytes.Buffer)
-	buf.WriteString(`table container-hostports {}
-delete table container-hostports;
-table container-hostports {
-  chain prerouting {
-    type nat hook prerouting priority filter; policy accept;
-`)
-
-	if portMapTCP.Len() != 0 {
-		buf.WriteString("    fib daddr type local dnat to tcp dport map @host-ports-tcp;\n")
-	}
-	if portMapUDP.Len() != 0 {
-		buf.WriteString("    fib daddr type local dnat to udp dport map @host-ports-udp;\n")
-	}
-	buf.WriteString("  }\n")
-
-	if portMapTCP.Len() != 0 {
-		buf.WriteString("  map host-ports-tcp {\n    type inet_service : ipv4_addr . inet_service;\n    elements = {\n")
-		portMapTCP.WriteTo(buf)
-		buf.WriteString("    }\n  }\n")
-	}
-	if portMapUDP.Len() != 0 {
-		buf.WriteString("  map host-ports-udp {\n    type inet_service : ipv4_addr . inet_service;\n    elements = {\n")
-		portMapUDP.WriteTo(buf)
-		buf.WriteString("    }\n  }\n")
+		PublishInterfaces: node.PublishInterfaces,
+	})
+	if err != nil {
+		// keep the current rules
+		log.Error().Err(err).Msg("invalid ruleset")
+		return true
 	}
 
-	buf.WriteString("}\n")
-
-	hash := xxhash.Sum64(buf.Bytes())
 	if hash == prevRulesHash {
+		// a new container can be published by the same rules (ie: restarted with the same IP)
+		observePropagation(mappings, time.Now())
+		setupSynproxySysctls(slices.ContainsFunc(mappings, Mapping.synproxy))
+		setState(State{RendererVersion: rendererVersion, RulesHash: hash, Mappings: mappings,
+			SysctlsBeforeSynproxy: savedSynproxySysctls()})
 		return true
 	}
 
@@ -193,6 +180,8 @@ table container-hostports {
 		fmt.Println(buf)
 	}
 
+	saveMissCounts()
+
 	cmd := exec.Command("nft", "-f", "-")
 	cmd.Stdin = buf
 	cmd.Stdout = os.Stdout
@@ -205,11 +194,12 @@ table container-hostports {
 	log.Info().Msg("new nft rules applied")
 	prevRulesHash = hash
 
-	return true
-}
+	observePropagation(mappings, time.Now())
+
+	setupSynproxySysctls(slices.ContainsFunc(mappings, Mapping.synproxy))
 
-type PortMapping struct {
-	HostPort      int
-	ContainerPort int
-	Protocol      string
+	setState(State{RendererVersion: rendererVersion, RulesHash: hash, Mappings: mappings,
+		SysctlsBeforeSynproxy: savedSynproxySysctls()})
+
+	return true
 }
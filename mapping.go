@@ -0,0 +1,253 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	reassignPortRangeFlag = flag.String("reassign-port-range", "",
+		"reassign conflicting host ports to a free port in this range (ie: 30000-30999); conflicts are ignored when empty")
+
+	reassignPortRange *PortRange
+)
+
+// Mapping is a published host port.
+type Mapping struct {
+	Protocol      string `json:"protocol"`
+	HostPort      int    `json:"hostPort"`
+	IP            string `json:"ip"`
+	ContainerPort int    `json:"containerPort"`
+
+	// RequestedHostPort is the host port requested by the container when it had to be reassigned.
+	RequestedHostPort int `json:"requestedHostPort,omitempty"`
+
+	ContainerID   string `json:"containerId"`
+	ContainerName string `json:"containerName"`
+	PodNamespace  string `json:"podNamespace"`
+	PodName       string `json:"podName"`
+	PodUID        string `json:"podUID"`
+
+	Policy PolicySettings `json:"policy"`
+	Mirror *Mirror        `json:"mirror,omitempty"`
+
+	podAnnotations map[string]string
+	// containerCreatedAt is the creation time of the container, in nanoseconds since the epoch
+	containerCreatedAt int64
+}
+
+// PortKey identifies a published host port.
+type PortKey struct {
+	Protocol string `json:"protocol" yaml:"protocol"`
+	HostPort int    `json:"hostPort" yaml:"hostPort"`
+}
+
+func (m Mapping) Key() PortKey {
+	return PortKey{m.Protocol, m.HostPort}
+}
+
+func (m Mapping) reassignKey() string {
+	return m.ContainerID + "/" + m.Protocol + "/" + strconv.Itoa(m.HostPort)
+}
+
+type PortRange struct {
+	First int
+	Last  int
+}
+
+func parsePortRange(s string) (r PortRange, err error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+
+	if r.First, err = strconv.Atoi(first); err != nil {
+		return
+	}
+	if r.Last, err = strconv.Atoi(last); err != nil {
+		return
+	}
+
+	if r.First < 1 || r.Last > 65535 || r.First > r.Last {
+		err = fmt.Errorf("invalid port range: %q", s)
+	}
+	return
+}
+
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(r.First)
+	}
+	return strconv.Itoa(r.First) + "-" + strconv.Itoa(r.Last)
+}
+
+func (r PortRange) Contains(port int) bool {
+	return port >= r.First && port <= r.Last
+}
+
+// buildMappings returns the mappings to publish, static ones first.
+func buildMappings(containers []Container, cfg *Config) (mappings []Mapping) {
+	mappings = make([]Mapping, 0)
+
+	for _, m := range cfg.staticMappings() {
+		if !node.allows(m) {
+			log.Debug().Str("protocol", m.Protocol).Int("host-port", m.HostPort).Msg("static mapping not allowed on this node")
+			continue
+		}
+		mappings = append(mappings, m)
+	}
+
+	for _, ctr := range containers {
+		log := log.With().Str("container-id", ctr.ID).Str("container-name", ctr.Name).
+			Str("pod-ns", ctr.Pod.Namespace).Str("pod-name", ctr.Pod.Name).Logger()
+
+		// the table is IPv4 only, one invalid IP must not invalidate the other mappings
+		if ip, err := netip.ParseAddr(ctr.Pod.IP); err != nil || !ip.Is4() || ip.String() != ctr.Pod.IP {
+			log.Warn().Str("pod-ip", ctr.Pod.IP).Msg("pod IP is not an IPv4 address, host ports ignored")
+			continue
+		}
+
+		for _, port := range ctr.Ports {
+			if port.HostPort == 0 {
+				continue
+			}
+
+			switch port.Protocol {
+			case "TCP", "UDP":
+			default:
+				log.Debug().Str("protocol", port.Protocol).Int("host-port", port.HostPort).Msg("unsupported protocol ignored")
+				continue
+			}
+
+			mapping := Mapping{
+				Protocol:      port.Protocol,
+				HostPort:      port.HostPort,
+				IP:            ctr.Pod.IP,
+				ContainerPort: port.ContainerPort,
+				ContainerID:   ctr.ID,
+				ContainerName: ctr.Name,
+				PodNamespace:  ctr.Pod.Namespace,
+				PodName:       ctr.Pod.Name,
+				PodUID:        ctr.Pod.UID,
+
+				podAnnotations:     ctr.Pod.Annotations,
+				containerCreatedAt: ctr.CreatedAt,
+			}
+
+			if cfg.excluded(mapping) {
+				log.Debug().Str("protocol", port.Protocol).Int("host-port", port.HostPort).Msg("excluded host port ignored")
+				continue
+			}
+
+			if !node.allows(mapping) {
+				log.Debug().Str("protocol", port.Protocol).Int("host-port", port.HostPort).Msg("host port not allowed on this node")
+				continue
+			}
+
+			mappings = append(mappings, mapping)
+		}
+	}
+
+	mappings = assignHostPorts(mappings)
+
+	// reassigned ports must be allowed too
+	mappings = slices.DeleteFunc(mappings, func(m Mapping) bool {
+		if m.RequestedHostPort == 0 || node.allows(m) {
+			return false
+		}
+		log.Debug().Str("container-id", m.ContainerID).Str("protocol", m.Protocol).Int("host-port", m.RequestedHostPort).
+			Int("reassigned-host-port", m.HostPort).Msg("reassigned host port not allowed on this node, ignored")
+		return true
+	})
+
+	// configured policies have precedence over annotations
+	for i := range mappings {
+		m := &mappings[i]
+		m.Policy = cfg.policy(*m)
+		m.Policy.merge(annotationSettings(*m))
+	}
+	resetInvalidAnnotations()
+
+	return
+}
+
+// reassignedPorts remembers the host ports given to conflicting mappings so they are stable across runs.
+var reassignedPorts = map[string]int{}
+
+// assignHostPorts resolves host port conflicts between mappings. The first mapping (oldest container) keeps the port;
+// later ones are either ignored or, if a reassign range is configured, moved to a free port of that range.
+func assignHostPorts(mappings []Mapping) (assigned []Mapping) {
+	requested := map[PortKey]bool{}
+	for _, m := range mappings {
+		requested[m.Key()] = true
+	}
+
+	taken := map[PortKey]bool{}
+	isFree := func(protocol string, port int) bool {
+		key := PortKey{protocol, port}
+		return !requested[key] && !taken[key]
+	}
+
+	newReassignedPorts := map[string]int{}
+	assigned = make([]Mapping, 0, len(mappings))
+
+	for _, m := range mappings {
+		if !taken[m.Key()] {
+			taken[m.Key()] = true
+			assigned = append(assigned, m)
+			continue
+		}
+
+		log := log.With().Str("container-id", m.ContainerID).Str("pod-ns", m.PodNamespace).Str("pod-name", m.PodName).
+			Str("protocol", m.Protocol).Int("host-port", m.HostPort).Logger()
+
+		if reassignPortRange == nil {
+			log.Warn().Msg("duplicate host port ignored")
+			continue
+		}
+
+		key := m.reassignKey()
+
+		port := reassignedPorts[key]
+		isNew := false
+		if port == 0 || !reassignPortRange.Contains(port) || !isFree(m.Protocol, port) {
+			port, isNew = 0, true
+			for p := reassignPortRange.First; p <= reassignPortRange.Last; p++ {
+				if isFree(m.Protocol, p) {
+					port = p
+					break
+				}
+			}
+		}
+
+		if port == 0 {
+			log.Warn().Str("range", reassignPortRange.String()).Msg("duplicate host port ignored: no free port to reassign it to")
+			continue
+		}
+
+		taken[PortKey{m.Protocol, port}] = true
+		newReassignedPorts[key] = port
+
+		m.RequestedHostPort = m.HostPort
+		m.HostPort = port
+
+		if isNew {
+			log.Warn().Int("reassigned-host-port", port).Msg("duplicate host port reassigned")
+			kube.postPodEvent(m, "Warning", "HostPortReassigned",
+				fmt.Sprintf("%s host port %d of container %s conflicts with another container, reassigned to %d",
+					m.Protocol, m.RequestedHostPort, m.ContainerName, m.HostPort))
+		}
+
+		assigned = append(assigned, m)
+	}
+
+	reassignedPorts = newReassignedPorts
+
+	return
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var metricsAddr = flag.String("metrics-addr", "",
+	"listen address of the read-only /metrics and /misses endpoints (ie: :7789 for Prometheus; empty to disable)")
+
+var (
+	startTime = time.Now()
+
+	propagationLatency = newHistogram(0.25, 0.5, 1, 2, 5, 10, 30, 60, 120, 300)
+
+	// publishedContainerPorts are the container's host ports published by the last applied rules
+	publishedContainerPorts = map[string]bool{}
+)
+
+// startMetricsServer serves the read-only endpoints, apart from the admin API so they can be exposed to a scraper.
+func startMetricsServer() {
+	if *metricsAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/misses", handleMisses)
+
+	go func() {
+		err := http.ListenAndServe(*metricsAddr, mux)
+		log.Fatal().Err(err).Str("metrics-addr", *metricsAddr).Msg("metrics server failed")
+	}()
+}
+
+// observePropagation records the propagation latency of the container mappings published by the rules just applied.
+// Containers created before the daemon started are ignored, their latency being the daemon's downtime.
+func observePropagation(mappings []Mapping, appliedAt time.Time) {
+	published := make(map[string]bool, len(mappings))
+
+	for _, m := range mappings {
+		if m.ContainerID == "" {
+			continue
+		}
+
+		key := m.ContainerID + "/" + m.Protocol + "/" + strconv.Itoa(m.HostPort)
+		published[key] = true
+
+		if publishedContainerPorts[key] {
+			continue
+		}
+
+		createdAt := time.Unix(0, m.containerCreatedAt)
+		if createdAt.Before(startTime) {
+			continue
+		}
+
+		latency := appliedAt.Sub(createdAt)
+		propagationLatency.observe(latency.Seconds())
+
+		log.Debug().Str("container-id", m.ContainerID).Str("protocol", m.Protocol).Int("host-port", m.HostPort).
+			Dur("latency", latency).Msg("mapping published")
+	}
+
+	publishedContainerPorts = published
+}
+
+// histogram is a Prometheus histogram.
+type histogram struct {
+	mutex   sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(buf *bytes.Buffer, name, help string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	writeMetricHeader(buf, name, "histogram", help)
+	for i, bound := range h.bounds {
+		writeMetric(buf, name+"_bucket", `le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"`, strconv.FormatUint(h.buckets[i], 10))
+	}
+	writeMetric(buf, name+"_bucket", `le="+Inf"`, strconv.FormatUint(h.count, 10))
+	writeMetric(buf, name+"_sum", "", strconv.FormatFloat(h.sum, 'g', -1, 64))
+	writeMetric(buf, name+"_count", "", strconv.FormatUint(h.count, 10))
+}
+
+// handleMetrics serves the metrics in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+
+	counts, err := listMissCounts()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read DNAT miss counters")
+	}
+
+	writeMetricHeader(buf, "knl_nft_dnat_misses_total", "counter", "Connections to host ports without a published mapping.")
+	for _, count := range counts {
+		writeMetric(buf, "knl_nft_dnat_misses_total", missLabels(count), strconv.FormatUint(count.Packets, 10))
+	}
+
+	writeMetricHeader(buf, "knl_nft_dnat_misses_bytes_total", "counter", "Bytes of the first packets of the connections to host ports without a published mapping.")
+	for _, count := range counts {
+		writeMetric(buf, "knl_nft_dnat_misses_bytes_total", missLabels(count), strconv.FormatUint(count.Bytes, 10))
+	}
+
+	propagationLatency.write(buf, "knl_nft_propagation_latency_seconds",
+		"Delay between the creation of a container and the application of the rules publishing its host ports.")
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buf.WriteTo(w)
+}
+
+func missLabels(count MissCount) string {
+	protocol, ports, _ := strings.Cut(count.Ports, "/")
+	return `protocol="` + protocol + `",ports="` + ports + `"`
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, metricType, help string) {
+	buf.WriteString("# HELP " + name + " " + help + "\n")
+	buf.WriteString("# TYPE " + name + " " + metricType + "\n")
+}
+
+func writeMetric(buf *bytes.Buffer, name, labels, value string) {
+	buf.WriteString(name)
+	if labels != "" {
+		buf.WriteString("{" + labels + "}")
+	}
+	buf.WriteString(" " + value + "\n")
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// legacyChainPrefixes are the nat chains of the CNI portmap plugin and of kube-proxy's hostport support.
+var legacyChainPrefixes = []string{"CNI-HOSTPORT-", "CNI-DN-", "KUBE-HOSTPORTS", "KUBE-HP-"}
+
+func isLegacyChain(chain string) bool {
+	for _, prefix := range legacyChainPrefixes {
+		if strings.HasPrefix(chain, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyRules are the host port rules of the nat table not managed by knl-nft.
+type legacyRules struct {
+	// Mappings are the DNATs of the rules.
+	Mappings []StaticMapping
+	// Entries are the rules jumping to the legacy chains from the other chains (as iptables arguments, without -A).
+	Entries [][]string
+	// Chains are the legacy chains.
+	Chains []string
+
+	// positions are the 1-based positions of the entries in their chains
+	positions []int
+	// jumps are the legacy chains jumped to from each legacy chain
+	jumps map[string][]string
+}
+
+func migrateCommand(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	yes := flags.Bool("yes", false, "do the migration (only show what would be done otherwise)")
+	iptables := flags.String("iptables", "iptables", "iptables command of the legacy rules (ie: iptables-legacy)")
+	fragment := flags.String("fragment", "90-migrated.yaml", "configuration fragment of the pinned static mappings")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long to wait for knl-nft to publish the legacy mappings")
+	verifyTimeout := flags.Duration("verify-timeout", time.Minute, "how long to wait for connections DNATed by knl-nft to every legacy mapping")
+	allowUnverified := flags.Bool("allow-unverified", false, "remove the legacy rules even if some mappings got no connection (ie: idle ports)")
+	pinUnpublished := flags.Bool("pin-unpublished", false, "keep the legacy mappings not published by knl-nft as static mappings (skipped otherwise)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: knl-nft migrate [-yes] [-iptables <command>] [-timeout <duration>] [-verify-timeout <duration>]")
+		fmt.Fprintln(flags.Output(), "                       [-allow-unverified] [-pin-unpublished] [-fragment <file>]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if out, err := nft("list", "tables"); err == nil && bytes.Contains(out, []byte(" cni_hostport")) {
+		log.Warn().Msg("the nftables backend of the portmap plugin (cni_hostport table) is not migrated automatically")
+	}
+
+	save, err := exec.Command(*iptables+"-save", "-t", "nat").Output()
+	if err != nil {
+		log.Fatal().Err(err).Str("iptables", *iptables).Msg("failed to list the nat rules")
+	}
+
+	legacy, err := parseLegacyRules(bytes.NewReader(save))
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to parse the nat rules")
+	}
+
+	if len(legacy.Chains) == 0 {
+		log.Info().Msg("no legacy host port rules found")
+		return
+	}
+
+	for _, m := range legacy.Mappings {
+		log.Info().Str("protocol", m.Protocol).Int("host-port", m.HostPort).Str("ip", m.IP).Int("port", m.Port).Msg("legacy mapping found")
+	}
+
+	// knl-nft must be running to publish the mappings before the legacy rules are removed
+	state, err := readStateFile()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to read the state file, is knl-nft running?")
+	}
+
+	// mappings not published by knl-nft are usually left by dead pods, their IP may be reused by another pod
+	statics := make([]StaticMapping, 0)
+	verified := make([]StaticMapping, 0, len(legacy.Mappings))
+	for _, m := range legacy.Mappings {
+		key := PortKey{m.Protocol, m.HostPort}
+
+		idx := slices.IndexFunc(state.Mappings, func(sm Mapping) bool { return sm.Key() == key })
+		switch {
+		case idx == -1 && *pinUnpublished:
+			statics = append(statics, m)
+			verified = append(verified, m)
+		case idx == -1:
+			log.Warn().Str("protocol", m.Protocol).Int("host-port", m.HostPort).Str("ip", m.IP).Int("port", m.Port).
+				Msg("legacy mapping not published by knl-nft, skipped (use -pin-unpublished to keep it)")
+		case state.Mappings[idx].IP != m.IP || state.Mappings[idx].ContainerPort != m.Port:
+			log.Warn().Str("protocol", m.Protocol).Int("host-port", m.HostPort).Str("ip", m.IP).
+				Msg("host port published by knl-nft to another destination, legacy mapping ignored")
+		default:
+			verified = append(verified, m)
+		}
+	}
+
+	fragmentFile := filepath.Join(*configDir, *fragment)
+	fragmentYAML, err := yaml.Marshal(struct {
+		StaticMappings []StaticMapping `yaml:"staticMappings"`
+	}{statics})
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to render the configuration fragment")
+	}
+	fragmentYAML = append([]byte("# migrated from legacy host port rules\n"), fragmentYAML...)
+
+	entries, chains, kept := legacy.removalCommands()
+	for _, entry := range kept {
+		log.Warn().Str("chain", entry[0]).Str("target", argValue(entry, "-j")).
+			Msg("legacy entry rule kept, knl-nft does not replace it (local connections or hairpin masquerade)")
+	}
+
+	if !*yes {
+		if len(statics) != 0 {
+			fmt.Println("# " + fragmentFile)
+			os.Stdout.Write(fragmentYAML)
+		}
+		for _, args := range append(entries, chains...) {
+			line := *iptables
+			for _, arg := range args {
+				if strings.ContainsAny(arg, " \"") {
+					arg = strconv.Quote(arg)
+				}
+				line += " " + arg
+			}
+			fmt.Println(line)
+		}
+		log.Info().Msg("dry run, use -yes to migrate")
+		return
+	}
+
+	if len(statics) != 0 {
+		if err := os.MkdirAll(*configDir, 0o755); err != nil {
+			log.Fatal().Err(err).Msg("failed to create the configuration directory")
+		}
+		if err := os.WriteFile(fragmentFile, fragmentYAML, 0o644); err != nil {
+			log.Fatal().Err(err).Msg("failed to write the configuration fragment")
+		}
+		log.Info().Str("file", fragmentFile).Int("static-mappings", len(statics)).Msg("configuration fragment written")
+	}
+
+	// the legacy rules stay in place until knl-nft publishes every mapping kept
+	if err := waitPublished(verified, *timeout); err != nil {
+		log.Fatal().Err(err).Msg("verification failed, legacy rules kept")
+	}
+	log.Info().Msg("legacy mappings published by knl-nft")
+
+	runIptables := func(commands [][]string) {
+		for _, args := range commands {
+			if out, err := exec.Command(*iptables, args...).CombinedOutput(); err != nil {
+				log.Fatal().Err(err).Strs("args", args).Str("output", strings.TrimSpace(string(out))).Msg("iptables failed")
+			}
+		}
+	}
+
+	// once the legacy DNATs are out of the way, the connections must be DNATed by knl-nft
+	runIptables(entries)
+	log.Info().Dur("timeout", *verifyTimeout).Msg("legacy entry rules removed, waiting for connections DNATed by knl-nft")
+
+	unverified := waitDNATed(verified, *verifyTimeout)
+	for _, m := range unverified {
+		log.Warn().Str("protocol", m.Protocol).Int("host-port", m.HostPort).Str("ip", m.IP).Int("port", m.Port).
+			Msg("no connection DNATed by knl-nft to the mapping")
+	}
+	if len(unverified) != 0 && !*allowUnverified {
+		runIptables(legacy.restoreCommands())
+		log.Fatal().Int("unverified", len(unverified)).
+			Msg("verification failed, legacy entry rules restored (use -allow-unverified for idle ports)")
+	}
+
+	runIptables(chains)
+
+	log.Info().Int("entries", len(entries)).Int("kept-entries", len(kept)).Msg("legacy rules removed")
+}
+
+// parseLegacyRules parses the output of iptables-save -t nat.
+func parseLegacyRules(in io.Reader) (legacy legacyRules, err error) {
+	type rule struct {
+		chain string
+		args  []string
+	}
+
+	rules := make([]rule, 0)
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, ":"):
+			chain, _, _ := strings.Cut(line[1:], " ")
+			if isLegacyChain(chain) {
+				legacy.Chains = append(legacy.Chains, chain)
+			}
+
+		case strings.HasPrefix(line, "-A "):
+			args, err := splitArgs(line[3:])
+			if err != nil {
+				return legacy, err
+			}
+			if len(args) < 2 {
+				continue
+			}
+			rules = append(rules, rule{args[0], args[1:]})
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	// kube-proxy matches the host port when jumping to the per-port chain
+	jumpPorts := map[string][2]string{}
+	legacy.jumps = map[string][]string{}
+	positions := map[string]int{}
+
+	for _, r := range rules {
+		target := argValue(r.args, "-j")
+		positions[r.chain]++
+
+		if !isLegacyChain(r.chain) {
+			if isLegacyChain(target) {
+				legacy.Entries = append(legacy.Entries, append([]string{r.chain}, r.args...))
+				legacy.positions = append(legacy.positions, positions[r.chain])
+			}
+			continue
+		}
+
+		if !isLegacyChain(target) {
+			continue
+		}
+		if !slices.Contains(legacy.jumps[r.chain], target) {
+			legacy.jumps[r.chain] = append(legacy.jumps[r.chain], target)
+		}
+
+		protocol, port := argValue(r.args, "-p"), argValue(r.args, "--dport", "--dports")
+		if port != "" {
+			jumpPorts[target] = [2]string{protocol, port}
+		}
+	}
+
+	for _, r := range rules {
+		if !isLegacyChain(r.chain) || argValue(r.args, "-j") != "DNAT" {
+			continue
+		}
+
+		protocol, port := argValue(r.args, "-p"), argValue(r.args, "--dport", "--dports")
+		if jump, ok := jumpPorts[r.chain]; ok {
+			if protocol == "" {
+				protocol = jump[0]
+			}
+			if port == "" {
+				port = jump[1]
+			}
+		}
+
+		m, err := legacyMapping(protocol, port, argValue(r.args, "--to-destination"))
+		if err != nil {
+			log.Warn().Err(err).Str("chain", r.chain).Strs("rule", r.args).Msg("legacy DNAT rule not understood, ignored")
+			continue
+		}
+
+		if !slices.Contains(legacy.Mappings, m) {
+			legacy.Mappings = append(legacy.Mappings, m)
+		}
+	}
+
+	return
+}
+
+func legacyMapping(protocol, port, destination string) (m StaticMapping, err error) {
+	if m.Protocol, err = validProtocol(protocol); err != nil {
+		return
+	}
+
+	if m.HostPort, err = strconv.Atoi(port); err != nil || !validPort(m.HostPort) {
+		return m, fmt.Errorf("invalid host port: %q", port)
+	}
+
+	addrPort, apErr := netip.ParseAddrPort(destination)
+	if apErr != nil {
+		// no port means the host port
+		addr, aErr := netip.ParseAddr(destination)
+		if aErr != nil {
+			return m, fmt.Errorf("invalid destination: %q", destination)
+		}
+		addrPort = netip.AddrPortFrom(addr, uint16(m.HostPort))
+	}
+
+	if !addrPort.Addr().Is4() {
+		return m, fmt.Errorf("not an IPv4 destination: %q", destination)
+	}
+
+	m.IP = addrPort.Addr().String()
+	m.Port = int(addrPort.Port())
+	return
+}
+
+// removalCommands returns the iptables arguments removing the legacy rules handling the traffic coming from the
+// network: the PREROUTING entry rules, then the chains no longer used.
+// knl-nft does not replace the DNAT of local connections (OUTPUT) nor portmap's hairpin masquerade (POSTROUTING), so
+// their entry rules are kept with the chains they use, and returned as kept.
+func (legacy legacyRules) removalCommands() (entries, chains, kept [][]string) {
+	used := map[string]bool{}
+
+	var use func(chain string)
+	use = func(chain string) {
+		if used[chain] {
+			return
+		}
+		used[chain] = true
+		for _, target := range legacy.jumps[chain] {
+			use(target)
+		}
+	}
+
+	for _, entry := range legacy.Entries {
+		if entry[0] == "PREROUTING" {
+			entries = append(entries, append([]string{"-t", "nat", "-D"}, entry...))
+			continue
+		}
+		kept = append(kept, entry)
+		use(argValue(entry, "-j"))
+	}
+
+	unused := make([]string, 0, len(legacy.Chains))
+	for _, chain := range legacy.Chains {
+		if !used[chain] {
+			unused = append(unused, chain)
+		}
+	}
+
+	for _, chain := range unused {
+		chains = append(chains, []string{"-t", "nat", "-F", chain})
+	}
+	for _, chain := range unused {
+		chains = append(chains, []string{"-t", "nat", "-X", chain})
+	}
+	return
+}
+
+// restoreCommands returns the iptables arguments inserting back the PREROUTING entry rules removed by the removal
+// commands, at their positions.
+func (legacy legacyRules) restoreCommands() (commands [][]string) {
+	for i, entry := range legacy.Entries {
+		if entry[0] != "PREROUTING" {
+			continue
+		}
+		commands = append(commands, append([]string{"-t", "nat", "-I", entry[0], strconv.Itoa(legacy.positions[i])}, entry[1:]...))
+	}
+	return
+}
+
+// waitDNATed waits for connections DNATed by knl-nft to the mappings, and returns the mappings without any.
+func waitDNATed(mappings []StaticMapping, timeout time.Duration) (unverified []StaticMapping) {
+	deadline := time.Now().Add(timeout)
+	unverified = mappings
+
+	for {
+		remaining := make([]StaticMapping, 0, len(unverified))
+		for _, m := range unverified {
+			count, err := dnatedConnections(m)
+			if err != nil {
+				log.Error().Err(err).Str("protocol", m.Protocol).Int("host-port", m.HostPort).Msg("failed to list the connections")
+			}
+			if count == 0 {
+				remaining = append(remaining, m)
+			}
+		}
+		unverified = remaining
+
+		if len(unverified) == 0 || time.Now().After(deadline) {
+			return
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// dnatedConnections returns the number of conntrack entries of the mapping marked by knl-nft's DNAT.
+func dnatedConnections(m StaticMapping) (count int, err error) {
+	mark := fmt.Sprintf("%#x/%#x", *hostPortCtMark, *hostPortCtMark)
+
+	out, err := exec.Command("conntrack", "-L", "-p", strings.ToLower(m.Protocol),
+		"--orig-port-dst", strconv.Itoa(m.HostPort), "--dst-nat", "--reply-src", m.IP,
+		"--reply-port-src", strconv.Itoa(m.Port), "--mark", mark).Output()
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.TrimSpace(line) != "" {
+			count++
+		}
+	}
+	return
+}
+
+// waitPublished waits for knl-nft's table to publish the mappings.
+func waitPublished(mappings []StaticMapping, timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		missing := 0
+
+		objects, err := nftListTable()
+		if err == nil {
+			for _, m := range mappings {
+				if !publishedInTable(objects, m) {
+					missing++
+				}
+			}
+			if missing == 0 {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("%d mappings not published after %s", missing, timeout)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// argValue returns the value following the first of the options in an iptables rule.
+func argValue(args []string, options ...string) string {
+	for i := 0; i+1 < len(args); i++ {
+		if slices.Contains(options, args[i]) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// splitArgs splits an iptables-save rule into arguments, handling double quotes and backslash escapes.
+func splitArgs(line string) (args []string, err error) {
+	arg := new(strings.Builder)
+	inArg, quoted := false, false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case c == '\\' && i+1 < len(line):
+			i++
+			arg.WriteByte(line[i])
+			inArg = true
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case c == ' ' && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+
+	if quoted {
+		return nil, errors.New("unterminated quote: " + line)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// portmapSave is the nat table of a node with the CNI portmap plugin (iptables backend) publishing TCP and UDP ports.
+const portmapSave = `# Generated by iptables-save v1.8.7 on Tue Mar 12 10:21:03 2024
+*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:CNI-DN-1b8c6c4f5b8e2f0a3d7e1 - [0:0]
+:CNI-DN-9f2e4a6b1c3d5e7f9a0b2 - [0:0]
+:CNI-HOSTPORT-DNAT - [0:0]
+:CNI-HOSTPORT-MASQ - [0:0]
+:CNI-HOSTPORT-SETMARK - [0:0]
+-A PREROUTING -m addrtype --dst-type LOCAL -j CNI-HOSTPORT-DNAT
+-A OUTPUT -m addrtype --dst-type LOCAL -j CNI-HOSTPORT-DNAT
+-A POSTROUTING -m comment --comment "CNI portfwd requiring masquerade" -j CNI-HOSTPORT-MASQ
+-A CNI-DN-1b8c6c4f5b8e2f0a3d7e1 -s 10.244.0.0/24 -p tcp -m tcp --dport 8080 -j CNI-HOSTPORT-SETMARK
+-A CNI-DN-1b8c6c4f5b8e2f0a3d7e1 -s 127.0.0.1/32 -p tcp -m tcp --dport 8080 -j CNI-HOSTPORT-SETMARK
+-A CNI-DN-1b8c6c4f5b8e2f0a3d7e1 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 10.244.0.5:80
+-A CNI-DN-9f2e4a6b1c3d5e7f9a0b2 -s 10.244.0.0/24 -p udp -m udp --dport 53 -j CNI-HOSTPORT-SETMARK
+-A CNI-DN-9f2e4a6b1c3d5e7f9a0b2 -s 127.0.0.1/32 -p udp -m udp --dport 53 -j CNI-HOSTPORT-SETMARK
+-A CNI-DN-9f2e4a6b1c3d5e7f9a0b2 -p udp -m udp --dport 53 -j DNAT --to-destination 10.244.0.7:5353
+-A CNI-DN-9f2e4a6b1c3d5e7f9a0b2 -s 10.244.0.0/24 -p tcp -m tcp --dport 53 -j CNI-HOSTPORT-SETMARK
+-A CNI-DN-9f2e4a6b1c3d5e7f9a0b2 -s 127.0.0.1/32 -p tcp -m tcp --dport 53 -j CNI-HOSTPORT-SETMARK
+-A CNI-DN-9f2e4a6b1c3d5e7f9a0b2 -p tcp -m tcp --dport 53 -j DNAT --to-destination 10.244.0.7:5353
+-A CNI-HOSTPORT-DNAT -p tcp -m comment --comment "dnat name: \"cbr0\" id: \"6f0c1a2b3c4d\"" -m multiport --dports 8080 -j CNI-DN-1b8c6c4f5b8e2f0a3d7e1
+-A CNI-HOSTPORT-DNAT -p udp -m comment --comment "dnat name: \"cbr0\" id: \"8e1d2c3b4a5f\"" -m multiport --dports 53 -j CNI-DN-9f2e4a6b1c3d5e7f9a0b2
+-A CNI-HOSTPORT-DNAT -p tcp -m comment --comment "dnat name: \"cbr0\" id: \"8e1d2c3b4a5f\"" -m multiport --dports 53 -j CNI-DN-9f2e4a6b1c3d5e7f9a0b2
+-A CNI-HOSTPORT-MASQ -m mark --mark 0x2000/0x2000 -j MASQUERADE
+-A CNI-HOSTPORT-SETMARK -m comment --comment "CNI portfwd masquerade mark" -j MARK --set-xmark 0x2000/0x2000
+COMMIT
+# Completed on Tue Mar 12 10:21:03 2024
+`
+
+// kubeProxySave is the nat table of a node with kube-proxy (iptables mode): its Service DNATs are not host ports.
+const kubeProxySave = `# Generated by iptables-save v1.8.7 on Tue Mar 12 10:25:41 2024
+*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:KUBE-MARK-MASQ - [0:0]
+:KUBE-NODEPORTS - [0:0]
+:KUBE-POSTROUTING - [0:0]
+:KUBE-SEP-IT2ZTR26TO4XFPTO - [0:0]
+:KUBE-SERVICES - [0:0]
+:KUBE-SVC-TCOU7JCQXEZGVUNU - [0:0]
+-A PREROUTING -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A OUTPUT -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A POSTROUTING -m comment --comment "kubernetes postrouting rules" -j KUBE-POSTROUTING
+-A KUBE-MARK-MASQ -j MARK --set-xmark 0x4000/0x4000
+-A KUBE-POSTROUTING -m mark ! --mark 0x4000/0x4000 -j RETURN
+-A KUBE-POSTROUTING -j MARK --set-xmark 0x4000/0x0
+-A KUBE-POSTROUTING -m comment --comment "kubernetes service traffic requiring SNAT" -j MASQUERADE --random-fully
+-A KUBE-SEP-IT2ZTR26TO4XFPTO -s 10.244.0.2/32 -m comment --comment "kube-system/kube-dns:dns" -j KUBE-MARK-MASQ
+-A KUBE-SEP-IT2ZTR26TO4XFPTO -p udp -m comment --comment "kube-system/kube-dns:dns" -m udp -j DNAT --to-destination 10.244.0.2:53
+-A KUBE-SERVICES -d 10.96.0.10/32 -p udp -m comment --comment "kube-system/kube-dns:dns cluster IP" -m udp --dport 53 -j KUBE-SVC-TCOU7JCQXEZGVUNU
+-A KUBE-SERVICES -m comment --comment "kubernetes service nodeports; NOTE: this must be the last rule in this chain" -m addrtype --dst-type LOCAL -j KUBE-NODEPORTS
+-A KUBE-SVC-TCOU7JCQXEZGVUNU -m comment --comment "kube-system/kube-dns:dns -> 10.244.0.2:53" -j KUBE-SEP-IT2ZTR26TO4XFPTO
+COMMIT
+# Completed on Tue Mar 12 10:25:41 2024
+`
+
+// kubenetSave is the nat table of a node with kubenet, the kubelet publishing the host ports.
+const kubenetSave = `# Generated by iptables-save v1.8.4 on Tue Mar 12 10:31:17 2024
+*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:KUBE-HOSTPORTS - [0:0]
+:KUBE-HP-4YVONL46AKYWSKS3 - [0:0]
+:KUBE-HP-7THKRFSEH4GIIXK7 - [0:0]
+:KUBE-MARK-MASQ - [0:0]
+-A PREROUTING -m comment --comment "kube hostport portals" -m addrtype --dst-type LOCAL -j KUBE-HOSTPORTS
+-A OUTPUT -m comment --comment "kube hostport portals" -m addrtype --dst-type LOCAL -j KUBE-HOSTPORTS
+-A POSTROUTING -m comment --comment "SNAT for localhost access to hostports" -o cbr0 -s 127.0.0.0/8 -j MASQUERADE
+-A KUBE-HOSTPORTS -p tcp -m comment --comment "nginx-7c5ddbdf54-x2v4k_default hostport 8080" -m tcp --dport 8080 -j KUBE-HP-4YVONL46AKYWSKS3
+-A KUBE-HOSTPORTS -p udp -m comment --comment "syslog-5f7b9c_logging hostport 514" -m udp --dport 514 -j KUBE-HP-7THKRFSEH4GIIXK7
+-A KUBE-HP-4YVONL46AKYWSKS3 -s 10.244.1.5/32 -m comment --comment "nginx-7c5ddbdf54-x2v4k_default hostport 8080" -j KUBE-MARK-MASQ
+-A KUBE-HP-4YVONL46AKYWSKS3 -p tcp -m comment --comment "nginx-7c5ddbdf54-x2v4k_default hostport 8080" -m tcp -j DNAT --to-destination 10.244.1.5:80
+-A KUBE-HP-7THKRFSEH4GIIXK7 -s 10.244.1.9/32 -m comment --comment "syslog-5f7b9c_logging hostport 514" -j KUBE-MARK-MASQ
+-A KUBE-HP-7THKRFSEH4GIIXK7 -p udp -m comment --comment "syslog-5f7b9c_logging hostport 514" -m udp -j DNAT --to-destination 10.244.1.9
+-A KUBE-MARK-MASQ -j MARK --set-xmark 0x4000/0x4000
+COMMIT
+# Completed on Tue Mar 12 10:31:17 2024
+`
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string
+		err  bool
+	}{
+		{"", nil, false},
+		{"PREROUTING -m addrtype --dst-type LOCAL -j CNI-HOSTPORT-DNAT",
+			[]string{"PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CNI-HOSTPORT-DNAT"}, false},
+		{`POSTROUTING -m comment --comment "CNI portfwd requiring masquerade" -j CNI-HOSTPORT-MASQ`,
+			[]string{"POSTROUTING", "-m", "comment", "--comment", "CNI portfwd requiring masquerade", "-j", "CNI-HOSTPORT-MASQ"}, false},
+		{`CNI-HOSTPORT-DNAT -p tcp -m comment --comment "dnat name: \"cbr0\" id: \"6f0c\"" -j CNI-DN-1`,
+			[]string{"CNI-HOSTPORT-DNAT", "-p", "tcp", "-m", "comment", "--comment", `dnat name: "cbr0" id: "6f0c"`, "-j", "CNI-DN-1"}, false},
+		{`KUBE-SERVICES -m comment --comment "" -j KUBE-NODEPORTS`,
+			[]string{"KUBE-SERVICES", "-m", "comment", "--comment", "", "-j", "KUBE-NODEPORTS"}, false},
+		{"KUBE-HOSTPORTS  -p tcp ", []string{"KUBE-HOSTPORTS", "-p", "tcp"}, false},
+		{`KUBE-HOSTPORTS -m comment --comment "unterminated`, nil, true},
+	}
+
+	for _, test := range tests {
+		args, err := splitArgs(test.line)
+		if (err != nil) != test.err {
+			t.Errorf("splitArgs(%q): unexpected error: %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("splitArgs(%q) = %q, want %q", test.line, args, test.args)
+		}
+	}
+}
+
+func TestParseLegacyRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		save     string
+		mappings []StaticMapping
+		entries  []string
+		chains   []string
+	}{
+		{
+			name: "portmap",
+			save: portmapSave,
+			mappings: []StaticMapping{
+				{Protocol: "TCP", HostPort: 8080, IP: "10.244.0.5", Port: 80},
+				{Protocol: "UDP", HostPort: 53, IP: "10.244.0.7", Port: 5353},
+				{Protocol: "TCP", HostPort: 53, IP: "10.244.0.7", Port: 5353},
+			},
+			entries: []string{"PREROUTING", "OUTPUT", "POSTROUTING"},
+			chains: []string{"CNI-DN-1b8c6c4f5b8e2f0a3d7e1", "CNI-DN-9f2e4a6b1c3d5e7f9a0b2",
+				"CNI-HOSTPORT-DNAT", "CNI-HOSTPORT-MASQ", "CNI-HOSTPORT-SETMARK"},
+		},
+		{
+			name: "kube-proxy",
+			save: kubeProxySave,
+		},
+		{
+			name: "kubenet",
+			save: kubenetSave,
+			mappings: []StaticMapping{
+				{Protocol: "TCP", HostPort: 8080, IP: "10.244.1.5", Port: 80},
+				{Protocol: "UDP", HostPort: 514, IP: "10.244.1.9", Port: 514},
+			},
+			entries: []string{"PREROUTING", "OUTPUT"},
+			chains:  []string{"KUBE-HOSTPORTS", "KUBE-HP-4YVONL46AKYWSKS3", "KUBE-HP-7THKRFSEH4GIIXK7"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			legacy, err := parseLegacyRules(strings.NewReader(test.save))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(legacy.Mappings, test.mappings) {
+				t.Errorf("mappings = %+v, want %+v", legacy.Mappings, test.mappings)
+			}
+
+			var entries []string
+			for _, entry := range legacy.Entries {
+				entries = append(entries, entry[0])
+			}
+			if !reflect.DeepEqual(entries, test.entries) {
+				t.Errorf("entries from %q, want %q", entries, test.entries)
+			}
+
+			if !reflect.DeepEqual(legacy.Chains, test.chains) {
+				t.Errorf("chains = %q, want %q", legacy.Chains, test.chains)
+			}
+		})
+	}
+}
+
+func TestRemovalCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		save    string
+		entries [][]string
+		chains  [][]string
+		kept    []string
+		restore [][]string
+	}{
+		{
+			name: "portmap",
+			save: portmapSave,
+			entries: [][]string{
+				{"-t", "nat", "-D", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CNI-HOSTPORT-DNAT"},
+			},
+			kept: []string{"OUTPUT", "POSTROUTING"},
+			restore: [][]string{
+				{"-t", "nat", "-I", "PREROUTING", "1", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "CNI-HOSTPORT-DNAT"},
+			},
+		},
+		{
+			name: "kubenet",
+			save: kubenetSave,
+			entries: [][]string{
+				{"-t", "nat", "-D", "PREROUTING", "-m", "comment", "--comment", "kube hostport portals", "-m", "addrtype",
+					"--dst-type", "LOCAL", "-j", "KUBE-HOSTPORTS"},
+			},
+			kept: []string{"OUTPUT"},
+			restore: [][]string{
+				{"-t", "nat", "-I", "PREROUTING", "1", "-m", "comment", "--comment", "kube hostport portals", "-m", "addrtype",
+					"--dst-type", "LOCAL", "-j", "KUBE-HOSTPORTS"},
+			},
+		},
+		{
+			name: "unused chains",
+			save: `*nat
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:KUBE-HOSTPORTS - [0:0]
+:KUBE-HP-4YVONL46AKYWSKS3 - [0:0]
+:KUBE-SERVICES - [0:0]
+-A PREROUTING -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A PREROUTING -m addrtype --dst-type LOCAL -j KUBE-HOSTPORTS
+-A KUBE-HOSTPORTS -p tcp -m tcp --dport 8080 -j KUBE-HP-4YVONL46AKYWSKS3
+-A KUBE-HP-4YVONL46AKYWSKS3 -p tcp -m tcp -j DNAT --to-destination 10.244.1.5:80
+COMMIT
+`,
+			entries: [][]string{
+				{"-t", "nat", "-D", "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "KUBE-HOSTPORTS"},
+			},
+			chains: [][]string{
+				{"-t", "nat", "-F", "KUBE-HOSTPORTS"},
+				{"-t", "nat", "-F", "KUBE-HP-4YVONL46AKYWSKS3"},
+				{"-t", "nat", "-X", "KUBE-HOSTPORTS"},
+				{"-t", "nat", "-X", "KUBE-HP-4YVONL46AKYWSKS3"},
+			},
+			restore: [][]string{
+				{"-t", "nat", "-I", "PREROUTING", "2", "-m", "addrtype", "--dst-type", "LOCAL", "-j", "KUBE-HOSTPORTS"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			legacy, err := parseLegacyRules(strings.NewReader(test.save))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries, chains, kept := legacy.removalCommands()
+			if !reflect.DeepEqual(entries, test.entries) {
+				t.Errorf("entries = %q, want %q", entries, test.entries)
+			}
+			if !reflect.DeepEqual(chains, test.chains) {
+				t.Errorf("chains = %q, want %q", chains, test.chains)
+			}
+
+			var keptChains []string
+			for _, entry := range kept {
+				keptChains = append(keptChains, entry[0])
+			}
+			if !reflect.DeepEqual(keptChains, test.kept) {
+				t.Errorf("kept entries from %q, want %q", keptChains, test.kept)
+			}
+
+			if restore := legacy.restoreCommands(); !reflect.DeepEqual(restore, test.restore) {
+				t.Errorf("restore = %q, want %q", restore, test.restore)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	mirrorMaxDuration      = flag.Duration("mirror-max-duration", time.Hour, "maximum duration of a traffic mirror")
+	mirrorDestinationsFlag = flag.String("mirror-destinations", "",
+		"CIDRs where traffic can be mirrored through the admin API (ie: 10.1.2.0/24); mirroring is disabled when empty")
+
+	mirrorDestinations []netip.Prefix
+)
+
+// Mirror duplicates the packets sent to a host port to an analysis destination, until a given time.
+type Mirror struct {
+	PortKey `yaml:",inline"`
+
+	To     string    `json:"to" yaml:"to"`
+	Device string    `json:"device,omitempty" yaml:"device"`
+	Until  time.Time `json:"until" yaml:"until"`
+}
+
+var deviceRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.:-]{1,15}$`)
+
+func (m *Mirror) validate() (err error) {
+	if m.Protocol, err = validProtocol(m.Protocol); err != nil {
+		return
+	}
+	if !validPort(m.HostPort) {
+		return fmt.Errorf("invalid port: %d", m.HostPort)
+	}
+
+	ip, err := netip.ParseAddr(m.To)
+	if err != nil || !ip.Is4() {
+		return fmt.Errorf("invalid IPv4 address: %q", m.To)
+	}
+	m.To = ip.String()
+
+	if m.Device != "" && !deviceRegexp.MatchString(m.Device) {
+		return fmt.Errorf("invalid device: %q", m.Device)
+	}
+
+	return
+}
+
+// parseMirrorDestinations parses a comma-separated list of IPv4 CIDRs or addresses.
+func parseMirrorDestinations(s string) (prefixes []netip.Prefix, err error) {
+	for _, item := range splitList(s) {
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			addr, aErr := netip.ParseAddr(item)
+			if aErr != nil {
+				return nil, fmt.Errorf("invalid mirror destination: %q", item)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if !prefix.Addr().Is4() {
+			return nil, fmt.Errorf("not an IPv4 mirror destination: %q", item)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return
+}
+
+// mirrorAllowed returns true if traffic can be mirrored to the address through the admin API.
+func mirrorAllowed(to string) bool {
+	addr, err := netip.ParseAddr(to)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range mirrorDestinations {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	mirrorsMutex sync.Mutex
+	mirrors      = map[PortKey]Mirror{}
+)
+
+func setMirror(mirror Mirror) {
+	mirrorsMutex.Lock()
+	defer mirrorsMutex.Unlock()
+
+	mirrors[mirror.PortKey] = mirror
+}
+
+func removeMirror(key PortKey) (found bool) {
+	mirrorsMutex.Lock()
+	defer mirrorsMutex.Unlock()
+
+	_, found = mirrors[key]
+	delete(mirrors, key)
+	return
+}
+
+func listMirrors() (list []Mirror) {
+	mirrorsMutex.Lock()
+	defer mirrorsMutex.Unlock()
+
+	list = make([]Mirror, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		list = append(list, mirror)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Protocol != list[j].Protocol {
+			return list[i].Protocol < list[j].Protocol
+		}
+		return list[i].HostPort < list[j].HostPort
+	})
+	return
+}
+
+// applyMirrors attaches the active mirrors to their mappings, after removing the expired ones.
+func applyMirrors(mappings []Mapping, now time.Time) []Mapping {
+	mirrorsMutex.Lock()
+	defer mirrorsMutex.Unlock()
+
+	for key, mirror := range mirrors {
+		if now.After(mirror.Until) {
+			log.Info().Str("protocol", key.Protocol).Int("host-port", key.HostPort).Str("to", mirror.To).Msg("mirror expired")
+			delete(mirrors, key)
+		}
+	}
+
+	for i := range mappings {
+		if mirror, ok := mirrors[mappings[i].Key()]; ok {
+			mappings[i].Mirror = &mirror
+		}
+	}
+
+	return mappings
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	missPortsFlag = flag.String("miss-ports", "", "host port ranges where DNAT misses are counted ([proto/]first[-last],...)")
+	missWindow    = flag.Duration("miss-window", time.Hour, "how long DNAT misses are counted on host ports no longer published (0 to disable)")
+	missLog       = flag.Bool("miss-log", false, "log DNAT misses (rate limited)")
+)
+
+// MissPorts is a range of host ports where connections without a published mapping are counted.
+type MissPorts struct {
+	Protocol string
+	Ports    PortRange
+}
+
+// String returns the name of the range, used as the comment of its rule.
+func (m MissPorts) String() string {
+	return strings.ToLower(m.Protocol) + "/" + m.Ports.String()
+}
+
+var (
+	missPortRanges []MissPorts
+
+	// recentPorts are the last time host ports were seen published
+	recentPorts = map[PortKey]time.Time{}
+)
+
+// parseMissPorts parses a list of [proto/]first[-last], both protocols being used when not specified.
+func parseMissPorts(s string) (list []MissPorts, err error) {
+	list = make([]MissPorts, 0)
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		protocols := []string{"TCP", "UDP"}
+
+		protocol, portsStr, hasProtocol := strings.Cut(item, "/")
+		if hasProtocol {
+			protocol, err = validProtocol(protocol)
+			if err != nil {
+				return
+			}
+			protocols = []string{protocol}
+		} else {
+			portsStr = protocol
+		}
+
+		ports, err := parsePortRange(portsStr)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, protocol := range protocols {
+			list = append(list, MissPorts{protocol, ports})
+		}
+	}
+
+	return
+}
+
+// missPorts returns where DNAT misses are counted: the configured ranges and the host ports published in the
+// last -miss-window that are not anymore.
+func missPorts(mappings []Mapping, now time.Time) (list []MissPorts) {
+	published := map[PortKey]bool{}
+	for _, m := range mappings {
+		published[m.Key()] = true
+		recentPorts[m.Key()] = now
+	}
+
+	list = append(make([]MissPorts, 0), missPortRanges...)
+
+	for key, seen := range recentPorts {
+		if now.Sub(seen) > *missWindow {
+			delete(recentPorts, key)
+			continue
+		}
+
+		if published[key] {
+			continue
+		}
+
+		configured := false
+		for _, r := range missPortRanges {
+			if r.Protocol == key.Protocol && r.Ports.Contains(key.HostPort) {
+				configured = true
+				break
+			}
+		}
+		if configured {
+			continue
+		}
+
+		list = append(list, MissPorts{key.Protocol, PortRange{key.HostPort, key.HostPort}})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Protocol != list[j].Protocol {
+			return list[i].Protocol < list[j].Protocol
+		}
+		if list[i].Ports.First != list[j].Ports.First {
+			return list[i].Ports.First < list[j].Ports.First
+		}
+		return list[i].Ports.Last < list[j].Ports.Last
+	})
+
+	return
+}
+
+// MissCount is the count of DNAT misses on a range of host ports. Counted in a nat chain, Packets and Bytes are the
+// ones of the first packets of the connections.
+type MissCount struct {
+	Ports   string `json:"ports"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+var (
+	missCountsMutex sync.Mutex
+	// missCountsBase are the counts of the previous rulesets
+	missCountsBase = map[string]MissCount{}
+)
+
+// saveMissCounts keeps the counts of the current ruleset before it's replaced (counters are reset with the table).
+func saveMissCounts() {
+	counts, err := currentMissCounts()
+	if err != nil {
+		log.Debug().Err(err).Msg("failed to read DNAT miss counters")
+		return
+	}
+
+	missCountsMutex.Lock()
+	defer missCountsMutex.Unlock()
+
+	for _, count := range counts {
+		base := missCountsBase[count.Ports]
+		base.Ports = count.Ports
+		base.Packets += count.Packets
+		base.Bytes += count.Bytes
+		missCountsBase[count.Ports] = base
+	}
+}
+
+// listMissCounts returns the DNAT misses counted by this daemon and the current ruleset, sorted by ports.
+func listMissCounts() (list []MissCount, err error) {
+	counts, err := currentMissCounts()
+	if err != nil {
+		return
+	}
+
+	missCountsMutex.Lock()
+	defer missCountsMutex.Unlock()
+
+	byPorts := make(map[string]MissCount, len(missCountsBase))
+	for ports, count := range missCountsBase {
+		byPorts[ports] = count
+	}
+	for _, count := range counts {
+		total := byPorts[count.Ports]
+		total.Ports = count.Ports
+		total.Packets += count.Packets
+		total.Bytes += count.Bytes
+		byPorts[count.Ports] = total
+	}
+
+	list = make([]MissCount, 0, len(byPorts))
+	for _, count := range byPorts {
+		list = append(list, count)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Ports < list[j].Ports })
+	return
+}
+
+func currentMissCounts() (counts []MissCount, err error) {
+	objects, err := nftListTable()
+	if err != nil {
+		return
+	}
+
+	counts = make([]MissCount, 0)
+	for _, obj := range objects {
+		if obj.Rule == nil || obj.Rule.Chain != "misses" || obj.Rule.Comment == "" {
+			continue
+		}
+
+		packets, bytes, ok := obj.Rule.counter()
+		if !ok {
+			continue
+		}
+
+		counts = append(counts, MissCount{obj.Rule.Comment, packets, bytes})
+	}
+
+	return
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const tableName = "container-hostports"
+
+// nftObject is an object of nft's JSON output, only one field being set.
+type nftObject struct {
+	Table *nftTable `json:"table"`
+	Rule  *nftRule  `json:"rule"`
+	Map   *nftMap   `json:"map"`
+}
+
+type nftTable struct {
+	Name    string `json:"name"`
+	Comment string `json:"comment"`
+}
+
+type nftRule struct {
+	Chain   string `json:"chain"`
+	Handle  int    `json:"handle"`
+	Comment string `json:"comment"`
+	Expr    []any  `json:"expr"`
+}
+
+type nftMap struct {
+	Name string  `json:"name"`
+	Elem [][]any `json:"elem"`
+}
+
+// nftListTable returns the objects of our table, with handles.
+func nftListTable() (objects []nftObject, err error) {
+	out, err := nft("-j", "-a", "list", "table", "ip", tableName)
+	if err != nil {
+		return
+	}
+
+	listing := struct {
+		Nftables []nftObject `json:"nftables"`
+	}{}
+
+	if err = json.Unmarshal(out, &listing); err != nil {
+		return
+	}
+
+	return listing.Nftables, nil
+}
+
+func nft(args ...string) (out []byte, err error) {
+	cmd := exec.Command("nft", args...)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+
+	out, err = cmd.Output()
+	if err != nil {
+		err = fmt.Errorf("nft %v: %w: %s", args, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return
+}
+
+// counter returns the values of the rule's counter, if any.
+func (r *nftRule) counter() (packets, bytes uint64, ok bool) {
+	for _, expr := range r.Expr {
+		e, _ := expr.(map[string]any)
+		counter, _ := e["counter"].(map[string]any)
+		if counter == nil {
+			continue
+		}
+
+		p, _ := counter["packets"].(float64)
+		b, _ := counter["bytes"].(float64)
+		return uint64(p), uint64(b), true
+	}
+	return
+}
+
+// matchesPort returns true if the rule has a match on the given destination port.
+// It does not match rules where the port is part of a set.
+func (r *nftRule) matchesPort(protocol string, port int) bool {
+	for _, expr := range r.Expr {
+		e, _ := expr.(map[string]any)
+		match, _ := e["match"].(map[string]any)
+		if match == nil {
+			continue
+		}
+
+		if right, _ := match["right"].(float64); int(right) != port {
+			continue
+		}
+
+		left, _ := match["left"].(map[string]any)
+
+		if payload, _ := left["payload"].(map[string]any); payload != nil &&
+			payload["protocol"] == protocol && payload["field"] == "dport" {
+			return true
+		}
+
+		// the ct expression has no protocol, it's matched by meta l4proto
+		if ct, _ := left["ct"].(map[string]any); ct != nil &&
+			ct["key"] == "proto-dst" && ct["dir"] == "original" && r.matchesL4Proto(protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesL4Proto returns true if the rule has a match on the given layer 4 protocol.
+func (r *nftRule) matchesL4Proto(protocol string) bool {
+	for _, expr := range r.Expr {
+		e, _ := expr.(map[string]any)
+		match, _ := e["match"].(map[string]any)
+		if match == nil || match["right"] != protocol {
+			continue
+		}
+
+		left, _ := match["left"].(map[string]any)
+		if meta, _ := left["meta"].(map[string]any); meta != nil && meta["key"] == "l4proto" {
+			return true
+		}
+	}
+	return false
+}
+
+// publishedInTable returns true if one of the host port maps of the table has the mapping.
+func publishedInTable(objects []nftObject, m StaticMapping) bool {
+	proto := strings.ToLower(m.Protocol)
+
+	for _, obj := range objects {
+		switch {
+		case obj.Map != nil && obj.Map.Name == "host-ports-"+proto:
+			for _, elem := range obj.Map.Elem {
+				key, _ := elem[0].(float64)
+				value, _ := elem[1].(map[string]any)
+				concat, _ := value["concat"].([]any)
+				if int(key) != m.HostPort || len(concat) != 2 {
+					continue
+				}
+				ip, _ := concat[0].(string)
+				port, _ := concat[1].(float64)
+				if ip == m.IP && int(port) == m.Port {
+					return true
+				}
+			}
+
+		case obj.Map != nil && obj.Map.Name == "host-port-ranges-"+proto:
+			for _, elem := range obj.Map.Elem {
+				key, _ := elem[0].(map[string]any)
+				bounds, _ := key["range"].([]any)
+				ip, _ := elem[1].(string)
+				if len(bounds) != 2 || ip != m.IP || m.HostPort != m.Port {
+					continue
+				}
+				first, _ := bounds[0].(float64)
+				last, _ := bounds[1].(float64)
+				if (PortRange{int(first), int(last)}).Contains(m.HostPort) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+var nodeConfigFile = flag.String("node-config", "/etc/knl-nft/node.yaml", "node settings used when not set on the Node object")
+
+// Node object annotations (or labels, for single values) overriding the node settings.
+const (
+	nodeDisabledProtocolsKey = "knl-nft/disabled-protocols"
+	nodePortRangesKey        = "knl-nft/port-ranges"
+	nodePublishInterfacesKey = "knl-nft/publish-interfaces"
+)
+
+// NodeSettings are the behavior overrides of this node.
+type NodeSettings struct {
+	// DisabledProtocols are not published.
+	DisabledProtocols []string `yaml:"disabledProtocols"`
+	// PortRanges are the host ports that can be published (ie: "80", "30000-32767"), all if empty.
+	PortRanges []string `yaml:"portRanges"`
+	// PublishInterfaces are where host ports are published, all if empty.
+	PublishInterfaces []string `yaml:"publishInterfaces"`
+
+	portRanges []PortRange
+}
+
+// node are the settings of this node, resolved at startup.
+var node NodeSettings
+
+func (s *NodeSettings) validate() (err error) {
+	for i, protocol := range s.DisabledProtocols {
+		if s.DisabledProtocols[i], err = validProtocol(protocol); err != nil {
+			return
+		}
+	}
+
+	s.portRanges = make([]PortRange, 0, len(s.PortRanges))
+	for _, r := range s.PortRanges {
+		portRange, err := parsePortRange(r)
+		if err != nil {
+			return err
+		}
+		s.portRanges = append(s.portRanges, portRange)
+	}
+
+	for _, iface := range s.PublishInterfaces {
+		if !deviceRegexp.MatchString(iface) {
+			return fmt.Errorf("invalid interface: %q", iface)
+		}
+	}
+
+	return
+}
+
+// merge sets the settings not defined yet from other ones.
+func (s *NodeSettings) merge(other NodeSettings) {
+	if len(s.DisabledProtocols) == 0 {
+		s.DisabledProtocols = other.DisabledProtocols
+	}
+	if len(s.PortRanges) == 0 {
+		s.PortRanges, s.portRanges = other.PortRanges, other.portRanges
+	}
+	if len(s.PublishInterfaces) == 0 {
+		s.PublishInterfaces = other.PublishInterfaces
+	}
+}
+
+// allows returns true if the mapping can be published on this node.
+func (s *NodeSettings) allows(m Mapping) bool {
+	for _, protocol := range s.DisabledProtocols {
+		if m.Protocol == protocol {
+			return false
+		}
+	}
+
+	if len(s.portRanges) == 0 {
+		return true
+	}
+	for _, r := range s.portRanges {
+		if r.Contains(m.HostPort) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveNodeSettings sets the node settings from the Node object, then from the node config file for the settings
+// not defined on the Node object.
+func resolveNodeSettings() {
+	if kube != nil && *nodeName != "" {
+		settings, err := kubeNodeSettings()
+		if err != nil {
+			log.Error().Err(err).Str("node", *nodeName).Msg("failed to get the node settings from the Node object")
+		} else {
+			node = settings
+		}
+	}
+
+	settings, err := readNodeConfig(*nodeConfigFile)
+	if err != nil {
+		log.Error().Err(err).Str("file", *nodeConfigFile).Msg("failed to read the node config")
+	} else {
+		node.merge(settings)
+	}
+
+	log.Info().Strs("disabled-protocols", node.DisabledProtocols).Strs("port-ranges", node.PortRanges).
+		Strs("publish-interfaces", node.PublishInterfaces).Msg("node settings resolved")
+}
+
+func kubeNodeSettings() (settings NodeSettings, err error) {
+	ctx, cancel := context.WithTimeout(appCtx, 10*time.Second)
+	defer cancel()
+
+	obj := struct {
+		Metadata struct {
+			Labels      map[string]string `json:"labels"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}{}
+
+	if err = kube.do(ctx, http.MethodGet, "/api/v1/nodes/"+url.PathEscape(*nodeName), nil, &obj); err != nil {
+		return
+	}
+
+	value := func(key string) []string {
+		v, ok := obj.Metadata.Annotations[key]
+		if !ok {
+			v = obj.Metadata.Labels[key]
+		}
+		return splitList(v)
+	}
+
+	settings = NodeSettings{
+		DisabledProtocols: value(nodeDisabledProtocolsKey),
+		PortRanges:        value(nodePortRangesKey),
+		PublishInterfaces: value(nodePublishInterfacesKey),
+	}
+
+	err = settings.validate()
+	return
+}
+
+func readNodeConfig(file string) (settings NodeSettings, err error) {
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return settings, nil
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err = dec.Decode(&settings); err != nil && err != io.EOF {
+		return
+	}
+
+	err = settings.validate()
+	return
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(s string) (list []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
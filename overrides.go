@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// overrides are host ports forcibly removed through the admin API. They are kept until the containers change.
+var (
+	overridesMutex      sync.Mutex
+	overrides           = map[PortKey]string{}
+	containersSignature string
+)
+
+// applyOverrides filters out the overridden mappings, after forgetting overrides made before a container change.
+func applyOverrides(containers []Container, mappings []Mapping) (filtered []Mapping) {
+	ids := make([]string, 0, len(containers))
+	for _, ctr := range containers {
+		ids = append(ids, ctr.ID)
+	}
+	signature := strings.Join(ids, ",")
+
+	overridesMutex.Lock()
+	defer overridesMutex.Unlock()
+
+	containersSignature = signature
+
+	for key, overrideSignature := range overrides {
+		if overrideSignature != signature {
+			log.Info().Str("protocol", key.Protocol).Int("host-port", key.HostPort).Msg("containers changed, removing override")
+			delete(overrides, key)
+		}
+	}
+
+	if len(overrides) == 0 {
+		return mappings
+	}
+
+	filtered = make([]Mapping, 0, len(mappings))
+	for _, m := range mappings {
+		if _, overridden := overrides[m.Key()]; overridden {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	return
+}
+
+func addOverride(key PortKey) {
+	overridesMutex.Lock()
+	defer overridesMutex.Unlock()
+
+	overrides[key] = containersSignature
+}
+
+func listOverrides() (keys []PortKey) {
+	overridesMutex.Lock()
+	defer overridesMutex.Unlock()
+
+	keys = make([]PortKey, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Protocol != keys[j].Protocol {
+			return keys[i].Protocol < keys[j].Protocol
+		}
+		return keys[i].HostPort < keys[j].HostPort
+	})
+	return
+}
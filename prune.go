@@ -0,0 +1,198 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+func pruneCommand(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	pod := flags.String("pod", "", "prune the mappings of this pod (namespace/name)")
+	containerID := flags.String("container", "", "prune the mappings of this container (id or id prefix)")
+	port := flags.String("port", "", "prune this host port ([protocol/]port, both protocols if not specified)")
+	dryRun := flags.Bool("dry-run", false, "only show what would be pruned")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: knl-nft prune [-dry-run] {-pod <ns/name> | -container <id> | -port <[proto/]port>}")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	targets := make([]PortKey, 0)
+
+	if *port != "" {
+		protocol, portStr, hasProtocol := strings.Cut(*port, "/")
+		if !hasProtocol {
+			portStr = protocol
+		}
+
+		p, err := strconv.Atoi(portStr)
+		if err != nil || !validPort(p) {
+			log.Fatal().Str("port", *port).Msg("invalid port")
+		}
+
+		if hasProtocol {
+			protocol, err := validProtocol(protocol)
+			if err != nil {
+				log.Fatal().Err(err).Msg("invalid port")
+			}
+			targets = append(targets, PortKey{protocol, p})
+		} else {
+			targets = append(targets, PortKey{"TCP", p}, PortKey{"UDP", p})
+		}
+	}
+
+	if *pod != "" || *containerID != "" {
+		state, err := readStateFile()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read the state file")
+		}
+
+		for _, m := range state.Mappings {
+			if *pod != "" && *pod != m.PodNamespace+"/"+m.PodName {
+				continue
+			}
+			if *containerID != "" && (m.ContainerID == "" || !strings.HasPrefix(m.ContainerID, *containerID)) {
+				continue
+			}
+			targets = append(targets, m.Key())
+		}
+	}
+
+	if len(targets) == 0 {
+		log.Fatal().Msg("nothing to prune")
+	}
+
+	objects, err := nftListTable()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to list rules")
+	}
+
+	failed := false
+	for _, target := range targets {
+		if err := prune(target, objects, *dryRun); err != nil {
+			log.Error().Err(err).Str("protocol", target.Protocol).Int("host-port", target.HostPort).Msg("prune failed")
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func prune(target PortKey, objects []nftObject, dryRun bool) (err error) {
+	log := log.With().Str("protocol", target.Protocol).Int("host-port", target.HostPort).Logger()
+
+	commands, conntrack := pruneCommands(target, objects)
+
+	if dryRun {
+		for _, args := range commands {
+			fmt.Println("nft " + strings.Join(args, " "))
+		}
+		fmt.Println("conntrack " + strings.Join(conntrack, " "))
+		return
+	}
+
+	for _, args := range commands {
+		if _, err = nft(args...); err != nil {
+			return
+		}
+	}
+
+	// conntrack fails when no entry matched, so only log its output
+	out, ctErr := exec.Command("conntrack", conntrack...).CombinedOutput()
+	log.Info().Err(ctErr).Int("nft-commands", len(commands)).Str("conntrack", strings.TrimSpace(string(out))).Msg("pruned")
+
+	return
+}
+
+// pruneCommands returns the nft commands removing the host port from the table's objects, and the conntrack
+// arguments deleting its connections.
+func pruneCommands(target PortKey, objects []nftObject) (commands [][]string, conntrack []string) {
+	protocol := strings.ToLower(target.Protocol)
+
+	commands = make([][]string, 0)
+
+	// the pod IP the host port is DNATed to, if published
+	destination := ""
+
+	mapName := "host-ports-" + protocol
+	rangeMapName := "host-port-ranges-" + protocol
+
+	for _, obj := range objects {
+		switch {
+		case obj.Map != nil && obj.Map.Name == mapName:
+			for _, elem := range obj.Map.Elem {
+				if key, _ := elem[0].(float64); int(key) == target.HostPort {
+					value, _ := elem[1].(map[string]any)
+					if concat, _ := value["concat"].([]any); len(concat) == 2 {
+						destination, _ = concat[0].(string)
+					}
+					commands = append(commands, []string{"delete", "element", "ip", tableName, mapName,
+						"{", strconv.Itoa(target.HostPort), "}"})
+				}
+			}
+
+		case obj.Map != nil && obj.Map.Name == rangeMapName:
+			for _, elem := range obj.Map.Elem {
+				ip, _ := elem[1].(string)
+				if ip == "" {
+					continue
+				}
+
+				// single ports (ie: left by a previous split) are listed without range
+				var r PortRange
+				if port, ok := elem[0].(float64); ok {
+					r = PortRange{int(port), int(port)}
+				} else {
+					key, _ := elem[0].(map[string]any)
+					bounds, _ := key["range"].([]any)
+					if len(bounds) != 2 {
+						continue
+					}
+					first, _ := bounds[0].(float64)
+					last, _ := bounds[1].(float64)
+					r = PortRange{int(first), int(last)}
+				}
+				if !r.Contains(target.HostPort) {
+					continue
+				}
+
+				destination = ip
+
+				// split the range around the port
+				commands = append(commands, []string{"delete", "element", "ip", tableName, rangeMapName, "{", r.String(), "}"})
+
+				remaining := make([]string, 0, 2)
+				if r.First < target.HostPort {
+					remaining = append(remaining, PortRange{r.First, target.HostPort - 1}.String()+" : "+ip)
+				}
+				if target.HostPort < r.Last {
+					remaining = append(remaining, PortRange{target.HostPort + 1, r.Last}.String()+" : "+ip)
+				}
+				if len(remaining) != 0 {
+					commands = append(commands, []string{"add", "element", "ip", tableName, rangeMapName,
+						"{", strings.Join(remaining, ", "), "}"})
+				}
+			}
+
+		case obj.Rule != nil && obj.Rule.Chain != "misses" && obj.Rule.matchesPort(protocol, target.HostPort):
+			// misses are counted until the next run
+			commands = append(commands, []string{"delete", "rule", "ip", tableName, obj.Rule.Chain,
+				"handle", strconv.Itoa(obj.Rule.Handle)})
+		}
+	}
+
+	// only the connections DNATed to the host port, not the ones to a local service on the same port
+	conntrack = []string{"-D", "-p", protocol, "--orig-port-dst", strconv.Itoa(target.HostPort), "--dst-nat"}
+	if destination != "" {
+		conntrack = append(conntrack, "--reply-src", destination)
+	}
+	return
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// pruneTableJSON is the output of nft -j -a list table ip container-hostports, without the metainfo.
+const pruneTableJSON = `{"nftables": [
+  {"table": {"family": "ip", "name": "container-hostports", "handle": 7, "comment": "knl-nft rules 0123456789abcdef"}},
+  {"rule": {"family": "ip", "table": "container-hostports", "chain": "policy", "handle": 4, "expr": [
+    {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": 8080}},
+    {"match": {"op": "!=", "left": {"payload": {"protocol": "ip", "field": "saddr"}}, "right": {"set": [{"prefix": {"addr": "10.0.0.0", "len": 8}}]}}},
+    {"drop": null}]}},
+  {"rule": {"family": "ip", "table": "container-hostports", "chain": "forward", "handle": 5, "expr": [
+    {"match": {"op": "==", "left": {"meta": {"key": "l4proto"}}, "right": "tcp"}},
+    {"match": {"op": "==", "left": {"ct": {"key": "proto-dst", "dir": "original"}}, "right": 8080}},
+    {"limit": {"rate": 1, "per": "second", "rate_unit": "mbytes", "inv": true}},
+    {"drop": null}]}},
+  {"rule": {"family": "ip", "table": "container-hostports", "chain": "forward", "handle": 6, "expr": [
+    {"match": {"op": "==", "left": {"meta": {"key": "l4proto"}}, "right": "udp"}},
+    {"match": {"op": "==", "left": {"ct": {"key": "proto-dst", "dir": "original"}}, "right": 8080}},
+    {"limit": {"rate": 1, "per": "second", "rate_unit": "kbytes", "inv": true}},
+    {"drop": null}]}},
+  {"rule": {"family": "ip", "table": "container-hostports", "chain": "misses", "handle": 8, "comment": "tcp/8080", "expr": [
+    {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": 8080}},
+    {"counter": {"packets": 3, "bytes": 180}}]}},
+  {"map": {"family": "ip", "name": "host-ports-tcp", "table": "container-hostports", "type": "inet_service",
+    "handle": 2, "map": ["ipv4_addr", "inet_service"], "elem": [
+    [8080, {"concat": ["10.244.0.5", 80]}],
+    [8443, {"concat": ["10.244.0.5", 443]}]]}},
+  {"map": {"family": "ip", "name": "host-port-ranges-udp", "table": "container-hostports", "type": "inet_service",
+    "handle": 3, "map": "ipv4_addr", "flags": ["interval"], "elem": [
+    [{"range": [10000, 10003]}, "10.244.0.10"],
+    [10005, "10.244.0.10"]]}}
+]}`
+
+func TestPruneCommands(t *testing.T) {
+	listing := struct {
+		Nftables []nftObject `json:"nftables"`
+	}{}
+	if err := json.Unmarshal([]byte(pruneTableJSON), &listing); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target    PortKey
+		commands  [][]string
+		conntrack []string
+	}{
+		{
+			target: PortKey{"TCP", 8080},
+			commands: [][]string{
+				{"delete", "rule", "ip", tableName, "policy", "handle", "4"},
+				{"delete", "rule", "ip", tableName, "forward", "handle", "5"},
+				{"delete", "element", "ip", tableName, "host-ports-tcp", "{", "8080", "}"},
+			},
+			conntrack: []string{"-D", "-p", "tcp", "--orig-port-dst", "8080", "--dst-nat", "--reply-src", "10.244.0.5"},
+		},
+		{
+			// range start
+			target: PortKey{"UDP", 10000},
+			commands: [][]string{
+				{"delete", "element", "ip", tableName, "host-port-ranges-udp", "{", "10000-10003", "}"},
+				{"add", "element", "ip", tableName, "host-port-ranges-udp", "{", "10001-10003 : 10.244.0.10", "}"},
+			},
+			conntrack: []string{"-D", "-p", "udp", "--orig-port-dst", "10000", "--dst-nat", "--reply-src", "10.244.0.10"},
+		},
+		{
+			// range middle
+			target: PortKey{"UDP", 10002},
+			commands: [][]string{
+				{"delete", "element", "ip", tableName, "host-port-ranges-udp", "{", "10000-10003", "}"},
+				{"add", "element", "ip", tableName, "host-port-ranges-udp", "{", "10000-10001 : 10.244.0.10, 10003 : 10.244.0.10", "}"},
+			},
+			conntrack: []string{"-D", "-p", "udp", "--orig-port-dst", "10002", "--dst-nat", "--reply-src", "10.244.0.10"},
+		},
+		{
+			// range end
+			target: PortKey{"UDP", 10003},
+			commands: [][]string{
+				{"delete", "element", "ip", tableName, "host-port-ranges-udp", "{", "10000-10003", "}"},
+				{"add", "element", "ip", tableName, "host-port-ranges-udp", "{", "10000-10002 : 10.244.0.10", "}"},
+			},
+			conntrack: []string{"-D", "-p", "udp", "--orig-port-dst", "10003", "--dst-nat", "--reply-src", "10.244.0.10"},
+		},
+		{
+			// single port of an interval map
+			target: PortKey{"UDP", 10005},
+			commands: [][]string{
+				{"delete", "element", "ip", tableName, "host-port-ranges-udp", "{", "10005", "}"},
+			},
+			conntrack: []string{"-D", "-p", "udp", "--orig-port-dst", "10005", "--dst-nat", "--reply-src", "10.244.0.10"},
+		},
+		{
+			// the other protocol: only the UDP bandwidth rule
+			target: PortKey{"UDP", 8080},
+			commands: [][]string{
+				{"delete", "rule", "ip", tableName, "forward", "handle", "6"},
+			},
+			conntrack: []string{"-D", "-p", "udp", "--orig-port-dst", "8080", "--dst-nat"},
+		},
+		{
+			// not published
+			target:    PortKey{"TCP", 9090},
+			commands:  [][]string{},
+			conntrack: []string{"-D", "-p", "tcp", "--orig-port-dst", "9090", "--dst-nat"},
+		},
+	}
+
+	for _, test := range tests {
+		commands, conntrack := pruneCommands(test.target, listing.Nftables)
+
+		if !reflect.DeepEqual(commands, test.commands) {
+			t.Errorf("%v: commands = %q, want %q", test.target, commands, test.commands)
+		}
+		if !reflect.DeepEqual(conntrack, test.conntrack) {
+			t.Errorf("%v: conntrack = %q, want %q", test.target, conntrack, test.conntrack)
+		}
+	}
+}
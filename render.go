@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash"
+)
+
+// rendererVersion must be increased when the rendered ruleset changes for the same input.
+const rendererVersion = 3
+
+var (
+	hostPortCtMark = flag.Uint("host-port-ct-mark", 0x20000, "ct mark bit set on the connections DNATed to host ports")
+	connRateSize   = flag.Int("conn-rate-size", 65535, "maximum number of sources tracked by each connection rate limit")
+)
+
+// RenderInput is what a ruleset is rendered from.
+type RenderInput struct {
+	Mappings []Mapping
+	// Blocklist are the prefixes dropped before host ports DNAT, in canonical form.
+	Blocklist []string
+	// Misses are where connections not DNATed are counted, sorted.
+	Misses []MissPorts
+	// PublishInterfaces are where host ports are published, all if empty.
+	PublishInterfaces []string
+}
+
+// renderRules renders the nft ruleset publishing the mappings, and its hash.
+// The output is canonical: the same input always gives the same bytes, whatever the order of the mappings.
+func renderRules(input RenderInput) (buf *bytes.Buffer, hash uint64, err error) {
+	table := buildTable(input)
+	if err = table.validate(); err != nil {
+		return
+	}
+
+	buf = new(bytes.Buffer)
+	buf.WriteString("# knl-nft renderer v" + strconv.Itoa(rendererVersion) + "\n")
+	table.WriteText(buf)
+
+	// the applied table is identified by its comment
+	hash = xxhash.Sum64(buf.Bytes())
+	table.Comment = rulesComment(hash)
+
+	buf.Reset()
+	buf.WriteString("# knl-nft renderer v" + strconv.Itoa(rendererVersion) + "\n")
+	table.WriteText(buf)
+	return
+}
+
+// rulesComment is the comment of the table applied from the ruleset with the given hash.
+func rulesComment(hash uint64) string {
+	return fmt.Sprintf("knl-nft rules %016x", hash)
+}
+
+// buildTable returns the table publishing the mappings.
+func buildTable(input RenderInput) (table *Table) {
+	mappings := slices.Clone(input.Mappings)
+	sort.Slice(mappings, func(i, j int) bool {
+		mi, mj := mappings[i], mappings[j]
+		if mi.Protocol != mj.Protocol {
+			return mi.Protocol < mj.Protocol
+		}
+		return mi.HostPort < mj.HostPort
+	})
+
+	protocols := []string{"TCP", "UDP"}
+
+	portMaps := map[string]*Map{}
+	rangeMaps := map[string]*Map{}
+	for _, protocol := range protocols {
+		proto := strings.ToLower(protocol)
+		portMaps[protocol] = &Map{Name: "host-ports-" + proto, Type: "inet_service : ipv4_addr . inet_service"}
+		// only the address is translated, the port is kept
+		rangeMaps[protocol] = &Map{Name: "host-port-ranges-" + proto, Type: "inet_service : ipv4_addr", Interval: true}
+	}
+
+	prerouting := &Chain{Name: "prerouting", Hook: &Hook{"nat", "prerouting", "filter", "accept"}}
+	policy := &Chain{Name: "policy", Hook: &Hook{"filter", "prerouting", "mangle", "accept"}}
+	raw := &Chain{Name: "raw", Hook: &Hook{"filter", "prerouting", "raw", "accept"}}
+	inputChain := &Chain{Name: "input", Hook: &Hook{"filter", "input", "filter", "accept"}}
+	output := &Chain{Name: "output", Hook: &Hook{"nat", "output", "filter", "accept"}}
+	forward := &Chain{Name: "forward", Hook: &Hook{"filter", "forward", "filter", "accept"}}
+
+	mirrorRules := make([]Rule, 0)
+	synproxyPorts := make(AnonSet, 0)
+
+	for i := 0; i < len(mappings); i++ {
+		m := mappings[i]
+
+		if last := rangeEnd(mappings, i); last != i {
+			rangeMaps[m.Protocol].Elements = append(rangeMaps[m.Protocol].Elements,
+				Element{PortRange{m.HostPort, mappings[last].HostPort}, Addr(m.IP)})
+			i = last
+		} else {
+			portMaps[m.Protocol].Elements = append(portMaps[m.Protocol].Elements,
+				Element{Port(m.HostPort), Concat{Addr(m.IP), Port(m.ContainerPort)}})
+		}
+	}
+
+	local := Keyword("fib daddr type local")
+
+	// matches the published traffic, before DNAT (or the SYN proxy)
+	published := []Value{local}
+	if len(input.PublishInterfaces) != 0 {
+		ifaces := make(AnonSet, 0, len(input.PublishInterfaces))
+		for _, iface := range input.PublishInterfaces {
+			ifaces = append(ifaces, Quoted(iface))
+		}
+		published = append(published, Keyword("iifname"), ifaces)
+	}
+	publishedRule := func(values ...Value) Rule {
+		return rule(append(slices.Clone(published), values...)...)
+	}
+
+	if len(input.Blocklist) != 0 {
+		for _, protocol := range protocols {
+			ports := make([]int, 0)
+			for _, m := range mappings {
+				if m.Protocol == protocol {
+					ports = append(ports, m.HostPort)
+				}
+			}
+			if len(ports) == 0 {
+				continue
+			}
+
+			policy.Rules = append(policy.Rules, publishedRule(Keyword(strings.ToLower(protocol)+" dport"), portSet(ports),
+				Keyword("ip saddr"), Ref("blocklist"), Keyword("drop")))
+		}
+	}
+
+	for _, m := range mappings {
+		settings := m.Policy
+		proto := strings.ToLower(m.Protocol)
+
+		match := append(slices.Clone(published), Keyword(proto+" dport"), Port(m.HostPort))
+		matchRule := func(values ...Value) Rule {
+			return rule(append(slices.Clone(match), values...)...)
+		}
+
+		if len(settings.Sources) != 0 {
+			sources := make(AnonSet, 0, len(settings.Sources))
+			for _, source := range settings.Sources {
+				sources = append(sources, Prefix(source))
+			}
+			policy.Rules = append(policy.Rules, matchRule(Keyword("ip saddr !="), sources, Keyword("drop")))
+		}
+
+		if settings.ConnRateLimit != "" {
+			rate, prefixStr, _ := strings.Cut(settings.ConnRateLimit, " per /")
+			prefix, _ := strconv.Atoi(prefixStr)
+
+			source := []Value{Keyword("ip saddr")}
+			if prefix != 32 {
+				source = append(source, Keyword("and"), Addr(net.IP(net.CIDRMask(prefix, 32)).String()))
+			}
+
+			// sources expire after the rate's unit, so the meter only holds the recent ones
+			meter := Meter{Name: "conn-rate-" + proto + "-" + strconv.Itoa(m.HostPort), Size: *connRateSize, Key: source,
+				Timeout: rateUnitTimeout(rate), Rate: Rate(rate)}
+			if m.synproxy() {
+				// SYNs to the proxy are not tracked, so limit them before they're marked notrack
+				raw.Rules = append(raw.Rules, matchRule(Keyword("tcp flags syn"), meter, Keyword("drop")))
+			} else {
+				policy.Rules = append(policy.Rules, matchRule(Keyword("ct state new"), meter, Keyword("drop")))
+			}
+		}
+
+		if mirror := m.Mirror; mirror != nil {
+			dup := []Value{Keyword("dup to"), Addr(mirror.To)}
+			if mirror.Device != "" {
+				dup = append(dup, Keyword("device"), Quoted(mirror.Device))
+			}
+			mirrorRules = append(mirrorRules, matchRule(dup...))
+		}
+
+		if settings.Bandwidth != "" {
+			// matches both directions of the connections to the host port
+			// only the connections DNATed by us, not Services' ones to the same port
+			forward.Rules = append(forward.Rules, rule(Keyword("ct mark and"), Mark(*hostPortCtMark), Keyword("=="), Mark(*hostPortCtMark),
+				Keyword("ct status dnat meta l4proto "+proto+" ct original proto-dst"), Port(m.HostPort), Keyword("limit rate over"), Rate(settings.Bandwidth), Keyword("drop")))
+		}
+
+		if m.synproxy() {
+			// SYNs are not tracked, so they reach the input hook without DNAT where the proxy answers them
+			raw.Rules = append(raw.Rules, matchRule(Keyword("tcp flags syn notrack")))
+			inputChain.Rules = append(inputChain.Rules,
+				matchRule(Keyword("ct state invalid,untracked synproxy mss"), Num(*synproxyMSS),
+					Keyword("wscale"), Num(*synproxyWscale), Keyword("timestamp sack-perm")),
+				matchRule(Keyword("ct state invalid drop")))
+			synproxyPorts = append(synproxyPorts, Port(m.HostPort))
+		}
+	}
+
+	// mirror what's accepted
+	policy.Rules = append(policy.Rules, mirrorRules...)
+
+	// marks the connections to host ports, for the forward chain and to find them in the conntrack
+	dnat := func(proto string) []Value {
+		return []Value{Keyword("ct mark set ct mark or"), Mark(*hostPortCtMark), Keyword("dnat to " + proto + " dport map")}
+	}
+
+	for _, protocol := range protocols {
+		proto := strings.ToLower(protocol)
+		for _, m := range []*Map{portMaps[protocol], rangeMaps[protocol]} {
+			if len(m.Elements) != 0 {
+				prerouting.Rules = append(prerouting.Rules, publishedRule(append(dnat(proto), Ref(m.Name))...))
+			}
+		}
+	}
+
+	if len(synproxyPorts) != 0 {
+		// once the handshake is done, the proxy sends its SYN to the host port from the output hook (there's no input
+		// interface there, the proxy only answers on the published ones)
+		for _, m := range []*Map{portMaps["TCP"], rangeMaps["TCP"]} {
+			if len(m.Elements) != 0 {
+				output.Rules = append(output.Rules, rule(append([]Value{local, Keyword("tcp dport"), synproxyPorts},
+					append(dnat("tcp"), Ref(m.Name))...)...))
+			}
+		}
+	}
+
+	table = &Table{Name: tableName}
+	table.Chains = append(table.Chains, prerouting)
+
+	if len(input.Misses) != 0 {
+		// only reached when no map element matched
+		prerouting.Rules = append(prerouting.Rules, publishedRule(Verdict{"jump", "misses"}))
+
+		misses := &Chain{Name: "misses"}
+		for _, miss := range input.Misses {
+			r := rule(Keyword(strings.ToLower(miss.Protocol)+" dport"), miss.Ports, Keyword("counter"))
+			if *missLog {
+				r.Values = append(r.Values, Verdict{"goto", "miss-log"})
+			}
+			r.Comment = miss.String()
+			misses.Rules = append(misses.Rules, r)
+		}
+		table.Chains = append(table.Chains, misses)
+
+		if *missLog {
+			table.Chains = append(table.Chains, &Chain{Name: "miss-log", Rules: []Rule{
+				rule(Keyword("limit rate"), Rate("10/minute"), Keyword("burst 5 packets log prefix"), Quoted("knl-nft miss: "),
+					Keyword("level info")),
+			}})
+		}
+	}
+
+	for _, chain := range []*Chain{policy, raw, inputChain, output, forward} {
+		if len(chain.Rules) != 0 {
+			table.Chains = append(table.Chains, chain)
+		}
+	}
+
+	if len(input.Blocklist) != 0 {
+		blocklist := &Set{Name: "blocklist", Type: "ipv4_addr", Interval: true, AutoMerge: true}
+		for _, prefix := range input.Blocklist {
+			blocklist.Elements = append(blocklist.Elements, Element{Key: Prefix(prefix)})
+		}
+		table.Sets = append(table.Sets, blocklist)
+	}
+
+	for _, protocol := range protocols {
+		for _, m := range []*Map{portMaps[protocol], rangeMaps[protocol]} {
+			if len(m.Elements) != 0 {
+				table.Maps = append(table.Maps, m)
+			}
+		}
+	}
+
+	return
+}
+
+// rangeEnd returns the index of the last mapping of the range starting at mappings[start], or start if it does not
+// start a range. A range is made of consecutive host ports of a protocol, published on the same IP and port.
+// The mappings must be sorted.
+// Ranges translated to other container ports (ie: 10006-10007 to 20006-20007) can't be collapsed: a map's DNAT gives
+// an address and a port (or keeps the port), nft can't apply a port offset from a map. These stay per-port elements.
+// Maps have no auto-merge either (it's for interval sets), so contiguous ranges are merged here.
+func rangeEnd(mappings []Mapping, start int) (end int) {
+	end = start
+
+	isIdentity := func(m Mapping) bool { return m.HostPort == m.ContainerPort }
+
+	first := mappings[start]
+	if !isIdentity(first) {
+		return
+	}
+
+	for i := start + 1; i < len(mappings); i++ {
+		m, prev := mappings[i], mappings[i-1]
+		if m.Protocol != first.Protocol || m.IP != first.IP || m.HostPort != prev.HostPort+1 || !isIdentity(m) {
+			break
+		}
+		end = i
+	}
+	return
+}
+
+// portSet returns the anonymous set of sorted ports, contiguous ports being collapsed into ranges.
+func portSet(ports []int) (set AnonSet) {
+	set = make(AnonSet, 0, len(ports))
+
+	for i := 0; i < len(ports); i++ {
+		r := PortRange{ports[i], ports[i]}
+		for i+1 < len(ports) && ports[i+1] == r.Last+1 {
+			i++
+			r.Last = ports[i]
+		}
+		set = append(set, r)
+	}
+
+	return
+}
+
+// rateUnitTimeout returns the unit of a rate (ie: "20/minute") as an nft timeout (ie: "1m").
+func rateUnitTimeout(rate string) string {
+	_, unit, _ := strings.Cut(rate, "/")
+	return "1" + unit[:1]
+}
+
+func (m Mapping) synproxy() bool {
+	return m.Protocol == "TCP" && m.Policy.Synproxy != nil && *m.Policy.Synproxy
+}
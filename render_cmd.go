@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Fixture is an input of the render command.
+type Fixture struct {
+	ReassignPortRange string       `yaml:"reassignPortRange"`
+	Config            Config       `yaml:"config"`
+	Containers        []Container  `yaml:"containers"`
+	Mirrors           []Mirror     `yaml:"mirrors"`
+	Node              NodeSettings `yaml:"node"`
+	Blocklist         string       `yaml:"blocklist"`
+	MissPorts         string       `yaml:"missPorts"`
+	MissLog           bool         `yaml:"missLog"`
+	// UnpublishedPorts were published recently
+	UnpublishedPorts []PortKey `yaml:"unpublishedPorts"`
+}
+
+func renderCommand(args []string) {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	golden := flags.String("golden", "", "directory of fixtures (*.yaml) to check against their expected ruleset (*.nft)")
+	update := flags.Bool("update", false, "with -golden, write the expected rulesets instead of checking them")
+	format := flags.String("format", "text", "output format without -golden (text or json)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: knl-nft render [fixture.yaml...]")
+		fmt.Fprintln(flags.Output(), "       knl-nft render -golden <dir> [-update]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *golden == "" {
+		for _, file := range flags.Args() {
+			input, err := readFixture(file)
+			if err != nil {
+				log.Fatal().Err(err).Str("fixture", file).Msg("render failed")
+			}
+
+			switch *format {
+			case "text":
+				out, _, err := renderRules(input)
+				if err != nil {
+					log.Fatal().Err(err).Str("fixture", file).Msg("render failed")
+				}
+				out.WriteTo(os.Stdout)
+
+			case "json":
+				table := buildTable(input)
+				if err := table.validate(); err != nil {
+					log.Fatal().Err(err).Str("fixture", file).Msg("render failed")
+				}
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				enc.Encode(table)
+
+			default:
+				log.Fatal().Str("format", *format).Msg("unknown format")
+			}
+		}
+		return
+	}
+
+	fixtures, err := filepath.Glob(filepath.Join(*golden, "*.yaml"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to list fixtures")
+	}
+	if len(fixtures) == 0 {
+		log.Fatal().Str("dir", *golden).Msg("no fixtures found")
+	}
+
+	failed := 0
+	for _, fixture := range fixtures {
+		log := log.With().Str("fixture", fixture).Logger()
+
+		input, err := readFixture(fixture)
+		if err != nil {
+			log.Error().Err(err).Msg("render failed")
+			failed++
+			continue
+		}
+
+		buf, _, err := renderRules(input)
+		if err != nil {
+			log.Error().Err(err).Msg("render failed")
+			failed++
+			continue
+		}
+
+		out := buf.Bytes()
+		goldenFile := strings.TrimSuffix(fixture, ".yaml") + ".nft"
+
+		if *update {
+			if err := os.WriteFile(goldenFile, out, 0o644); err != nil {
+				log.Fatal().Err(err).Msg("failed to write expected ruleset")
+			}
+			continue
+		}
+
+		expected, err := os.ReadFile(goldenFile)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to read expected ruleset")
+			failed++
+			continue
+		}
+
+		if line, expectedLine, actualLine := firstDiff(expected, out); line != 0 {
+			log.Error().Int("line", line).Str("expected", expectedLine).Str("actual", actualLine).Msg("ruleset differs")
+			failed++
+		}
+	}
+
+	if *update {
+		log.Info().Int("fixtures", len(fixtures)).Msg("expected rulesets written")
+		return
+	}
+
+	if failed != 0 {
+		log.Fatal().Int("failed", failed).Int("fixtures", len(fixtures)).Msg("golden check failed")
+	}
+
+	log.Info().Int("fixtures", len(fixtures)).Msg("golden check passed")
+}
+
+// readFixture returns the render input of a fixture.
+func readFixture(file string) (input RenderInput, err error) {
+	ba, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+
+	fixture := Fixture{}
+
+	dec := yaml.NewDecoder(bytes.NewReader(ba))
+	dec.KnownFields(true)
+	if err = dec.Decode(&fixture); err != nil {
+		return
+	}
+
+	if err = fixture.Config.validate(); err != nil {
+		return
+	}
+
+	if err = fixture.Node.validate(); err != nil {
+		return
+	}
+	node = fixture.Node
+
+	reassignPortRange = nil
+	if fixture.ReassignPortRange != "" {
+		r, err := parsePortRange(fixture.ReassignPortRange)
+		if err != nil {
+			return input, err
+		}
+		reassignPortRange = &r
+	}
+	reassignedPorts = map[string]int{}
+
+	for _, ctr := range fixture.Containers {
+		if ctr.Pod.IP == "" {
+			return input, errors.New("container " + ctr.ID + " has no pod IP")
+		}
+	}
+
+	sort.SliceStable(fixture.Containers, func(i, j int) bool {
+		return fixture.Containers[i].CreatedAt < fixture.Containers[j].CreatedAt
+	})
+
+	mappings := buildMappings(fixture.Containers, &fixture.Config)
+
+	mirrors = map[PortKey]Mirror{}
+	for _, mirror := range fixture.Mirrors {
+		if err = mirror.validate(); err != nil {
+			return
+		}
+		setMirror(mirror)
+	}
+	mappings = applyMirrors(mappings, time.Time{})
+
+	blocklist, err := parseBlocklist(strings.NewReader(fixture.Blocklist))
+	if err != nil {
+		return
+	}
+
+	if missPortRanges, err = parseMissPorts(fixture.MissPorts); err != nil {
+		return
+	}
+	*missLog = fixture.MissLog
+	recentPorts = map[PortKey]time.Time{}
+	for _, key := range fixture.UnpublishedPorts {
+		if key.Protocol, err = validProtocol(key.Protocol); err != nil {
+			return
+		}
+		recentPorts[key] = time.Time{}
+	}
+
+	return RenderInput{
+		Mappings:  mappings,
+		Blocklist: blocklist,
+		Misses:    missPorts(mappings, time.Time{}),
+
+		PublishInterfaces: node.PublishInterfaces,
+	}, nil
+}
+
+// firstDiff returns the first differing line (1-based), or 0 if a and b are equal.
+func firstDiff(a, b []byte) (line int, aLine, bLine string) {
+	if bytes.Equal(a, b) {
+		return
+	}
+
+	aLines := strings.Split(string(a), "\n")
+	bLines := strings.Split(string(b), "\n")
+
+	for i := 0; ; i++ {
+		if i >= len(aLines) || i >= len(bLines) || aLines[i] != bLines[i] {
+			if i < len(aLines) {
+				aLine = aLines[i]
+			}
+			if i < len(bLines) {
+				bLine = bLines[i]
+			}
+			return i + 1, aLine, bLine
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestGolden checks the rulesets rendered from the fixtures, like render -golden testdata/golden.
+func TestGolden(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/golden/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures found")
+	}
+
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".yaml")
+
+		t.Run(name, func(t *testing.T) {
+			input, err := readFixture(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf, _, err := renderRules(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected, err := os.ReadFile(strings.TrimSuffix(fixture, ".yaml") + ".nft")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if line, expectedLine, actualLine := firstDiff(expected, buf.Bytes()); line != 0 {
+				t.Errorf("line %d: expected %q, got %q", line, expectedLine, actualLine)
+			}
+		})
+	}
+}
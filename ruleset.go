@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Table is the structured form of the ruleset (in the ip family). It is validated before being serialized, so values
+// coming from configs or annotations can't change the meaning of the rules.
+type Table struct {
+	Name    string   `json:"name"`
+	Comment string   `json:"comment,omitempty"`
+	Chains  []*Chain `json:"chains"`
+	Sets    []*Set   `json:"sets,omitempty"`
+	Maps    []*Map   `json:"maps,omitempty"`
+}
+
+// Chain is a chain of rules, base chain if it has a hook.
+type Chain struct {
+	Name  string `json:"name"`
+	Hook  *Hook  `json:"hook,omitempty"`
+	Rules []Rule `json:"rules"`
+}
+
+type Hook struct {
+	Type     string `json:"type"`
+	Hook     string `json:"hook"`
+	Priority string `json:"priority"`
+	Policy   string `json:"policy"`
+}
+
+// Set is a named set.
+type Set struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Interval  bool      `json:"interval,omitempty"`
+	AutoMerge bool      `json:"autoMerge,omitempty"`
+	Elements  []Element `json:"elements"`
+}
+
+// Map is a named map.
+type Map struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Interval bool      `json:"interval,omitempty"`
+	Elements []Element `json:"elements"`
+}
+
+// Element is an element of a set, or of a map when it has a Value.
+type Element struct {
+	Key   Value `json:"key"`
+	Value Value `json:"value,omitempty"`
+}
+
+// Rule is a sequence of values, serialized separated by spaces.
+type Rule struct {
+	Values  []Value `json:"values"`
+	Comment string  `json:"comment,omitempty"`
+}
+
+func rule(values ...Value) Rule {
+	return Rule{Values: values}
+}
+
+// Value is a typed part of a rule, set or map element.
+type Value interface {
+	String() string
+	validate() error
+}
+
+type (
+	// Keyword is a part of the nft syntax, like "fib daddr type local" or "drop".
+	Keyword string
+	// Num is a number, like a TCP MSS.
+	Num int
+	// Port is a host or container port.
+	Port int
+	// Addr is an IPv4 address.
+	Addr string
+	// Prefix is an IPv4 prefix.
+	Prefix string
+	// Rate is a limit rate, like "10/second" or "1 mbytes/second".
+	Rate string
+	// Quoted is a string that is quoted, like a device name.
+	Quoted string
+	// Mark is a ct mark.
+	Mark uint
+	// Ref is a reference to a named set or map (@name).
+	Ref string
+	// Concat is a concatenation of values (a . b).
+	Concat []Value
+	// AnonSet is an anonymous set ({ a, b }).
+	AnonSet []Value
+)
+
+// Verdict is a jump or goto to another chain.
+type Verdict struct {
+	Kind  string `json:"kind"`
+	Chain string `json:"chain"`
+}
+
+// Meter is a dynamic set of per-key limits, of at most Size keys expiring after Timeout.
+type Meter struct {
+	Name    string  `json:"name"`
+	Size    int     `json:"size"`
+	Key     []Value `json:"key"`
+	Timeout string  `json:"timeout"`
+	Rate    Rate    `json:"rate"`
+}
+
+var (
+	keywordRegexp    = regexp.MustCompile(`^[a-z0-9_,.:/!=-]+( [a-z0-9_,.:/!=-]+)*$`)
+	identifierRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]{0,63}$`)
+	rateRegexp       = regexp.MustCompile(`^[0-9]+( (bytes|kbytes|mbytes))?/(second|minute|hour|day)$`)
+	timeoutRegexp    = regexp.MustCompile(`^[0-9]+[smhd]$`)
+	quotedRegexp     = regexp.MustCompile(`^[^"\\\x00-\x1f\x7f]{0,127}$`)
+)
+
+func (v Keyword) String() string { return string(v) }
+func (v Num) String() string     { return strconv.Itoa(int(v)) }
+func (v Port) String() string    { return strconv.Itoa(int(v)) }
+func (v Addr) String() string    { return string(v) }
+func (v Prefix) String() string  { return string(v) }
+func (v Rate) String() string    { return string(v) }
+func (v Quoted) String() string  { return `"` + string(v) + `"` }
+func (v Ref) String() string     { return "@" + string(v) }
+func (v Mark) String() string    { return fmt.Sprintf("0x%08x", uint(v)) }
+
+func (v Concat) String() string  { return joinValues(v, " . ") }
+func (v AnonSet) String() string { return "{ " + joinValues(v, ", ") + " }" }
+
+func (v Verdict) String() string { return v.Kind + " " + v.Chain }
+
+func (v Meter) String() string {
+	return "meter " + v.Name + " size " + strconv.Itoa(v.Size) + " { " + joinValues(v.Key, " ") + " timeout " + v.Timeout +
+		" limit rate over " + v.Rate.String() + " }"
+}
+
+func joinValues(values []Value, sep string) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = v.String()
+	}
+	return strings.Join(s, sep)
+}
+
+func (v Keyword) validate() error { return checkRegexp("keyword", string(v), keywordRegexp) }
+func (v Rate) validate() error    { return checkRegexp("rate", string(v), rateRegexp) }
+func (v Quoted) validate() error  { return checkRegexp("quoted string", string(v), quotedRegexp) }
+func (v Ref) validate() error     { return checkRegexp("reference", string(v), identifierRegexp) }
+
+func (v Num) validate() error {
+	if v < 0 {
+		return fmt.Errorf("invalid number: %d", v)
+	}
+	return nil
+}
+
+func (v Mark) validate() error {
+	if v == 0 || v > 0xffffffff {
+		return fmt.Errorf("invalid mark: %d", v)
+	}
+	return nil
+}
+
+func (v Port) validate() error {
+	if !validPort(int(v)) {
+		return fmt.Errorf("invalid port: %d", v)
+	}
+	return nil
+}
+
+func (v Addr) validate() error {
+	ip, err := netip.ParseAddr(string(v))
+	if err != nil || !ip.Is4() || ip.String() != string(v) {
+		return fmt.Errorf("invalid IPv4 address: %q", string(v))
+	}
+	return nil
+}
+
+func (v Prefix) validate() error {
+	prefix, err := netip.ParsePrefix(string(v))
+	if err != nil || !prefix.Addr().Is4() || prefix.Masked().String() != string(v) {
+		return fmt.Errorf("invalid IPv4 prefix: %q", string(v))
+	}
+	return nil
+}
+
+func (v PortRange) validate() error {
+	if !validPort(v.First) || !validPort(v.Last) || v.First > v.Last {
+		return fmt.Errorf("invalid port range: %d-%d", v.First, v.Last)
+	}
+	return nil
+}
+
+func (v Concat) validate() error  { return validateValues(v) }
+func (v AnonSet) validate() error { return validateValues(v) }
+
+func (v Verdict) validate() error {
+	if v.Kind != "jump" && v.Kind != "goto" {
+		return fmt.Errorf("invalid verdict: %q", v.Kind)
+	}
+	return checkRegexp("chain name", v.Chain, identifierRegexp)
+}
+
+func (v Meter) validate() error {
+	if err := checkRegexp("meter name", v.Name, identifierRegexp); err != nil {
+		return err
+	}
+	if v.Size <= 0 {
+		return fmt.Errorf("invalid meter size: %d", v.Size)
+	}
+	if err := checkRegexp("meter timeout", v.Timeout, timeoutRegexp); err != nil {
+		return err
+	}
+	if err := validateValues(v.Key); err != nil {
+		return err
+	}
+	return v.Rate.validate()
+}
+
+func validateValues(values []Value) error {
+	if len(values) == 0 {
+		return fmt.Errorf("no values")
+	}
+	for _, v := range values {
+		if v == nil {
+			return fmt.Errorf("nil value")
+		}
+		if err := v.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkRegexp(what, s string, re *regexp.Regexp) error {
+	if !re.MatchString(s) {
+		return fmt.Errorf("invalid %s: %q", what, s)
+	}
+	return nil
+}
+
+var (
+	hookTypes      = []string{"filter", "nat"}
+	hookNames      = []string{"prerouting", "input", "forward", "output", "postrouting"}
+	hookPriorities = []string{"raw", "mangle", "dstnat", "filter", "security", "srcnat"}
+	hookPolicies   = []string{"accept", "drop"}
+)
+
+func (h *Hook) validate() error {
+	if !slices.Contains(hookTypes, h.Type) || !slices.Contains(hookNames, h.Hook) ||
+		!slices.Contains(hookPriorities, h.Priority) || !slices.Contains(hookPolicies, h.Policy) {
+		return fmt.Errorf("invalid hook: %+v", *h)
+	}
+	return nil
+}
+
+// validate checks the names, values and references of the table.
+func (t *Table) validate() (err error) {
+	if err = checkRegexp("table name", t.Name, identifierRegexp); err != nil {
+		return
+	}
+	if t.Comment != "" {
+		if err = Quoted(t.Comment).validate(); err != nil {
+			return
+		}
+	}
+
+	chains := map[string]bool{}
+	for _, chain := range t.Chains {
+		if err = checkRegexp("chain name", chain.Name, identifierRegexp); err != nil {
+			return
+		}
+		if chains[chain.Name] {
+			return fmt.Errorf("duplicate chain: %q", chain.Name)
+		}
+		chains[chain.Name] = true
+	}
+
+	named := map[string]bool{}
+	addNamed := func(name string, elements []Element, isMap bool) error {
+		if err := checkRegexp("set name", name, identifierRegexp); err != nil {
+			return err
+		}
+		if named[name] {
+			return fmt.Errorf("duplicate set or map: %q", name)
+		}
+		named[name] = true
+
+		for _, elem := range elements {
+			if elem.Key == nil || (elem.Value != nil) != isMap {
+				return fmt.Errorf("invalid element in %q", name)
+			}
+			values := []Value{elem.Key}
+			if isMap {
+				values = append(values, elem.Value)
+			}
+			if err := validateValues(values); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		return nil
+	}
+	for _, set := range t.Sets {
+		if err = addNamed(set.Name, set.Elements, false); err != nil {
+			return
+		}
+	}
+	for _, m := range t.Maps {
+		if err = addNamed(m.Name, m.Elements, true); err != nil {
+			return
+		}
+	}
+
+	for _, chain := range t.Chains {
+		if chain.Hook != nil {
+			if err = chain.Hook.validate(); err != nil {
+				return fmt.Errorf("chain %s: %w", chain.Name, err)
+			}
+		}
+
+		for _, r := range chain.Rules {
+			if err = r.validate(chains, named); err != nil {
+				return fmt.Errorf("chain %s: %w", chain.Name, err)
+			}
+		}
+	}
+
+	return
+}
+
+func (r Rule) validate(chains, named map[string]bool) (err error) {
+	if err = validateValues(r.Values); err != nil {
+		return
+	}
+
+	if r.Comment != "" {
+		if err = Quoted(r.Comment).validate(); err != nil {
+			return
+		}
+	}
+
+	for _, v := range r.Values {
+		switch v := v.(type) {
+		case Ref:
+			if !named[string(v)] {
+				return fmt.Errorf("undefined set or map: %q", string(v))
+			}
+		case Verdict:
+			if !chains[v.Chain] {
+				return fmt.Errorf("undefined chain: %q", v.Chain)
+			}
+		}
+	}
+	return
+}
+
+func (r Rule) String() string {
+	s := joinValues(r.Values, " ")
+	if r.Comment != "" {
+		s += " comment " + Quoted(r.Comment).String()
+	}
+	return s
+}
+
+// WriteText writes the table as an nft script replacing the current table.
+func (t *Table) WriteText(buf *bytes.Buffer) {
+	buf.WriteString("table " + t.Name + " {}\n")
+	buf.WriteString("delete table " + t.Name + ";\n")
+	buf.WriteString("table " + t.Name + " {\n")
+	if t.Comment != "" {
+		buf.WriteString("  comment " + Quoted(t.Comment).String() + ";\n")
+	}
+
+	for _, chain := range t.Chains {
+		buf.WriteString("  chain " + chain.Name + " {\n")
+		if h := chain.Hook; h != nil {
+			buf.WriteString("    type " + h.Type + " hook " + h.Hook + " priority " + h.Priority + "; policy " + h.Policy + ";\n")
+		}
+		for _, r := range chain.Rules {
+			buf.WriteString("    " + r.String() + ";\n")
+		}
+		buf.WriteString("  }\n")
+	}
+
+	writeElements := func(elements []Element) {
+		buf.WriteString("    elements = {\n")
+		for _, elem := range elements {
+			buf.WriteString("      " + elem.Key.String())
+			if elem.Value != nil {
+				buf.WriteString(" : " + elem.Value.String())
+			}
+			buf.WriteString(",\n")
+		}
+		buf.WriteString("    }\n")
+	}
+
+	for _, set := range t.Sets {
+		buf.WriteString("  set " + set.Name + " {\n    type " + set.Type + ";\n")
+		if set.Interval {
+			buf.WriteString("    flags interval;\n")
+		}
+		if set.AutoMerge {
+			buf.WriteString("    auto-merge;\n")
+		}
+		writeElements(set.Elements)
+		buf.WriteString("  }\n")
+	}
+
+	for _, m := range t.Maps {
+		buf.WriteString("  map " + m.Name + " {\n    type " + m.Type + ";\n")
+		if m.Interval {
+			buf.WriteString("    flags interval;\n")
+		}
+		writeElements(m.Elements)
+		buf.WriteString("  }\n")
+	}
+
+	buf.WriteString("}\n")
+}
+
+// MarshalJSON writes the values with their types, ie: {"port":80}.
+func (r Rule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Values  []any  `json:"values"`
+		Comment string `json:"comment,omitempty"`
+	}{typedValues(r.Values), r.Comment})
+}
+
+// MarshalJSON writes the key and value with their types.
+func (e Element) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Key   any `json:"key"`
+		Value any `json:"value,omitempty"`
+	}{Key: typedValue(e.Key)}
+	if e.Value != nil {
+		v.Value = typedValue(e.Value)
+	}
+	return json.Marshal(v)
+}
+
+func typedValues(values []Value) []any {
+	typed := make([]any, len(values))
+	for i, v := range values {
+		typed[i] = typedValue(v)
+	}
+	return typed
+}
+
+func typedValue(v Value) any {
+	var name string
+	var value any = v
+
+	switch v := v.(type) {
+	case Keyword:
+		name = "keyword"
+	case Num:
+		name = "num"
+	case Port:
+		name = "port"
+	case PortRange:
+		name, value = "range", []int{v.First, v.Last}
+	case Addr:
+		name = "addr"
+	case Prefix:
+		name = "prefix"
+	case Rate:
+		name = "rate"
+	case Quoted:
+		name = "string"
+	case Ref:
+		name = "ref"
+	case Mark:
+		name = "mark"
+	case Concat:
+		name, value = "concat", typedValues(v)
+	case AnonSet:
+		name, value = "set", typedValues(v)
+	case Verdict:
+		name = "verdict"
+	case Meter:
+		name, value = "meter", map[string]any{"name": v.Name, "size": v.Size, "key": typedValues(v.Key),
+			"timeout": v.Timeout, "rate": v.Rate}
+	default:
+		name = fmt.Sprintf("%T", v)
+	}
+
+	return map[string]any{name: value}
+}
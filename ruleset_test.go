@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTableValidate(t *testing.T) {
+	// table returns a valid table with the rule in its chain
+	table := func(r Rule) *Table {
+		return &Table{
+			Name: tableName,
+			Chains: []*Chain{
+				{Name: "prerouting", Hook: &Hook{"nat", "prerouting", "filter", "accept"}, Rules: []Rule{r}},
+				{Name: "misses"},
+			},
+			Sets: []*Set{{Name: "blocklist", Type: "ipv4_addr", Interval: true,
+				Elements: []Element{{Key: Prefix("10.0.0.0/8")}}}},
+			Maps: []*Map{{Name: "host-ports-tcp", Type: "inet_service : ipv4_addr . inet_service",
+				Elements: []Element{{Port(8080), Concat{Addr("10.244.0.5"), Port(80)}}}}},
+		}
+	}
+
+	tests := []struct {
+		name string
+		rule Rule
+		err  string
+	}{
+		{"valid", rule(Keyword("fib daddr type local iifname"), AnonSet{Quoted("eth0")},
+			Keyword("ip saddr"), Ref("blocklist"), Verdict{"jump", "misses"}), ""},
+		{"valid prefix", rule(Keyword("ip saddr"), Prefix("192.168.0.0/16"), Keyword("drop")), ""},
+
+		{"quoted with a quote", rule(Keyword("dup to"), Addr("10.0.0.1"), Keyword("device"), Quoted(`eth0" accept; "`)), "quoted string"},
+		{"quoted with a backslash", rule(Keyword("iifname"), Quoted(`eth0\`)), "quoted string"},
+		{"quoted with a newline", rule(Keyword("iifname"), Quoted("eth0\naccept")), "quoted string"},
+		{"comment with a quote", Rule{Values: []Value{Keyword("accept")}, Comment: `x"; flush ruleset; "`}, "quoted string"},
+		{"keyword with a semicolon", rule(Keyword("tcp dport 80 accept; flush ruleset")), "keyword"},
+		{"keyword with a brace", rule(Keyword("tcp dport { 80 } accept")), "keyword"},
+		{"keyword with a newline", rule(Keyword("accept\nflush ruleset")), "keyword"},
+		{"rate with a semicolon", rule(Keyword("limit rate"), Rate("10/second; flush ruleset")), "rate"},
+		{"undefined set", rule(Keyword("ip saddr"), Ref("allowlist"), Keyword("accept")), "undefined set or map"},
+		{"invalid ref", rule(Keyword("ip saddr"), Ref("blocklist accept")), "reference"},
+		{"undefined chain", rule(Verdict{"jump", "policy"}), "undefined chain"},
+		{"invalid verdict", rule(Verdict{"return", "misses"}), "verdict"},
+		{"non-canonical prefix", rule(Keyword("ip saddr"), Prefix("192.168.1.1/16"), Keyword("drop")), "prefix"},
+		{"invalid prefix", rule(Keyword("ip saddr"), Prefix("192.168.0.0/16 accept"), Keyword("drop")), "prefix"},
+		{"invalid address", rule(Keyword("dup to"), Addr("10.0.0.1 accept")), "address"},
+		{"valid meter", rule(Keyword("tcp flags syn"), Meter{Name: "conn-rate-tcp-22", Size: 65535,
+			Key: []Value{Keyword("ip saddr")}, Timeout: "1m", Rate: Rate("20/minute")}, Keyword("drop")), ""},
+		{"meter timeout with a brace", rule(Meter{Name: "conn-rate-tcp-22", Size: 65535,
+			Key: []Value{Keyword("ip saddr")}, Timeout: "1m } accept; meter x {", Rate: Rate("20/minute")}), "meter timeout"},
+		{"meter without size", rule(Meter{Name: "conn-rate-tcp-22", Key: []Value{Keyword("ip saddr")}, Timeout: "1m",
+			Rate: Rate("20/minute")}), "meter size"},
+		{"invalid port", rule(Keyword("tcp dport"), Port(65536), Keyword("accept")), "port"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := table(test.rule).validate()
+
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case test.err != "" && err == nil:
+				t.Errorf("rule %q accepted", test.rule.String())
+			case test.err != "" && !strings.Contains(err.Error(), test.err):
+				t.Errorf("error %q does not mention %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+var stateFile = flag.String("state-file", "/run/knl-nft/state.json", "file where the published mappings are written (empty to disable)")
+
+// State is what is currently published by knl-nft.
+type State struct {
+	// RendererVersion and RulesHash identify the applied ruleset
+	RendererVersion int    `json:"rendererVersion"`
+	RulesHash       uint64 `json:"rulesHash"`
+
+	Mappings []Mapping `json:"mappings"`
+
+	// SysctlsBeforeSynproxy are the sysctls to restore when the SYN proxy is no longer used
+	SysctlsBeforeSynproxy map[string]string `json:"sysctlsBeforeSynproxy,omitempty"`
+}
+
+var (
+	stateMutex   sync.Mutex
+	currentState = State{Mappings: []Mapping{}}
+
+	prevStateJSON []byte
+)
+
+func getState() State {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	return currentState
+}
+
+func setState(state State) {
+	stateMutex.Lock()
+	currentState = state
+	stateMutex.Unlock()
+
+	if *stateFile == "" {
+		return
+	}
+
+	if err := writeStateFile(state); err != nil {
+		log.Error().Err(err).Str("state-file", *stateFile).Msg("failed to write state file")
+	}
+}
+
+func writeStateFile(state State) (err error) {
+	ba, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return
+	}
+
+	if bytes.Equal(ba, prevStateJSON) {
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(*stateFile), 0o755); err != nil {
+		return
+	}
+
+	tmpFile := *stateFile + ".tmp"
+	if err = os.WriteFile(tmpFile, append(ba, '\n'), 0o644); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmpFile, *stateFile); err != nil {
+		return
+	}
+
+	prevStateJSON = ba
+	return
+}
+
+func readStateFile() (state State, err error) {
+	ba, err := os.ReadFile(*stateFile)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(ba, &state)
+	return
+}
+
+// restoreState reuses the hash of the applied ruleset from the state file, so a restart (or an upgrade not changing
+// the renderer) does not reapply the same ruleset. The hash is only reused if the table still has it in its comment
+// and publishes the mappings of the state (ie: not pruned). The sysctls changed for the SYN proxy and the reassigned
+// host ports are restored too.
+func restoreState() {
+	if *stateFile == "" {
+		return
+	}
+
+	state, err := readStateFile()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn().Err(err).Msg("failed to read the state file")
+		}
+		return
+	}
+
+	sysctlsBeforeSynproxy = state.SysctlsBeforeSynproxy
+
+	// reassigned ports stay the same, without new events
+	for _, m := range state.Mappings {
+		if m.RequestedHostPort == 0 {
+			continue
+		}
+		requested := m
+		requested.HostPort = m.RequestedHostPort
+		reassignedPorts[requested.reassignKey()] = m.HostPort
+	}
+
+	if state.RendererVersion != rendererVersion {
+		log.Info().Int("state-renderer-version", state.RendererVersion).Int("renderer-version", rendererVersion).
+			Msg("renderer changed, rules will be reapplied")
+		return
+	}
+
+	// the table may have been removed, replaced or pruned since
+	objects, err := nftListTable()
+	if err != nil {
+		return
+	}
+
+	applied := slices.ContainsFunc(objects, func(obj nftObject) bool {
+		return obj.Table != nil && obj.Table.Name == tableName && obj.Table.Comment == rulesComment(state.RulesHash)
+	})
+	if !applied {
+		log.Info().Msg("table changed since the last run, rules will be reapplied")
+		return
+	}
+
+	for _, m := range state.Mappings {
+		if !publishedInTable(objects, StaticMapping{m.Protocol, m.HostPort, m.IP, m.ContainerPort}) {
+			log.Info().Str("protocol", m.Protocol).Int("host-port", m.HostPort).
+				Msg("mapping no longer published, rules will be reapplied")
+			return
+		}
+	}
+
+	prevRulesHash = state.RulesHash
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	synproxyMSS    = flag.Int("synproxy-mss", 1460, "MSS announced by the SYN proxy")
+	synproxyWscale = flag.Int("synproxy-wscale", 7, "window scale announced by the SYN proxy")
+)
+
+// synproxySysctls are the settings needed by the SYN proxy. The conntrack must not pick up connections from their
+// middle, so the proxy sees the final ACKs of the handshakes as invalid.
+var synproxySysctls = map[string]string{
+	"net/netfilter/nf_conntrack_tcp_loose": "0",
+	"net/ipv4/tcp_syncookies":              "1",
+	"net/ipv4/tcp_timestamps":              "1",
+}
+
+var (
+	synproxySysctlsMutex sync.Mutex
+	// sysctlsBeforeSynproxy are the values to restore when the SYN proxy is no longer used. They are kept in the state
+	// file, so they're restored even after a restart.
+	sysctlsBeforeSynproxy map[string]string
+)
+
+func savedSynproxySysctls() map[string]string {
+	synproxySysctlsMutex.Lock()
+	defer synproxySysctlsMutex.Unlock()
+	return sysctlsBeforeSynproxy
+}
+
+// setupSynproxySysctls sets the sysctls needed by the SYN proxy when enabled, and restores them when disabled.
+func setupSynproxySysctls(enabled bool) {
+	synproxySysctlsMutex.Lock()
+	defer synproxySysctlsMutex.Unlock()
+
+	if enabled == (sysctlsBeforeSynproxy != nil) {
+		return
+	}
+
+	if enabled {
+		sysctlsBeforeSynproxy = map[string]string{}
+		for key, value := range synproxySysctls {
+			prev, err := os.ReadFile("/proc/sys/" + key)
+			if err != nil {
+				log.Error().Err(err).Str("sysctl", key).Msg("failed to read sysctl")
+				continue
+			}
+			sysctlsBeforeSynproxy[key] = strings.TrimSpace(string(prev))
+
+			writeSysctl(key, value)
+		}
+		return
+	}
+
+	for key, value := range sysctlsBeforeSynproxy {
+		writeSysctl(key, value)
+	}
+	sysctlsBeforeSynproxy = nil
+}
+
+func writeSysctl(key, value string) {
+	if err := os.WriteFile("/proc/sys/"+key, []byte(value+"\n"), 0o644); err != nil {
+		log.Error().Err(err).Str("sysctl", key).Str("value", value).Msg("failed to write sysctl")
+		return
+	}
+	log.Info().Str("sysctl", key).Str("value", value).Msg("sysctl set")
+}